@@ -2,55 +2,398 @@ package raa
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
-	"code.google.com/p/snappy-go/snappy"
 	"github.com/mcuadros/bolt"
 )
 
 type Archive struct {
-	path string
-	db   *bolt.DB
+	path      string
+	db        *bolt.DB
+	codec     CodecId
+	blockSize int32
+	dedup     bool
+	format    uint32
+	creator   string
+	createdAt time.Time
+	readOnly  bool
+	umask     os.FileMode
+
+	// kdf is not nil when the archive is encrypted, aead and dedupKey are
+	// set once the archive is unlocked
+	kdf      *kdfParams
+	aead     cipher.AEAD
+	dedupKey []byte
+
+	// tx is set on the copies of the archive bound to a transaction by
+	// Update or View, every operation runs on it instead of a new one
+	tx *bolt.Tx
+}
+
+// FormatVersion is the version of the archive layout written by this package
+const FormatVersion uint32 = 3
+
+// Version is the version of this package
+const Version = "0.1.0"
+
+// Creator identifies the tool creating the archives, is recorded at the meta
+// of the new archives
+var Creator = "go-raa " + Version
+
+// ArchiveMagic is stored at the meta of every archive, identifies the bolt
+// files containing a raa archive
+var ArchiveMagic = []byte("raa")
+
+// ArchiveFormatError is returned opening a file that is not a raa archive, or
+// an archive written with an unsupported format version
+type ArchiveFormatError struct {
+	Path string
+	// Version is the format version of the archive, 0 if the file is not
+	// a raa archive
+	Version uint32
+}
+
+func (e *ArchiveFormatError) Error() string {
+	if e.Version == 0 {
+		return fmt.Sprintf("%s: not a raa archive", e.Path)
+	}
+
+	return fmt.Sprintf(
+		"%s: unsupported archive format version %d, supported %d",
+		e.Path, e.Version, FormatVersion,
+	)
 }
 
 var (
-	rootBucket = []byte("root")
+	rootBucket   = []byte("root")
+	inodesBucket = []byte("inodes")
+	metaBucket   = []byte("meta")
+	indexBucket  = []byte("index")
+	xattrsBucket = []byte("xattrs")
+
+	inodeEntry   = []byte("inode")
+	magicKey     = []byte("magic")
+	formatKey    = []byte("format")
+	creatorKey   = []byte("creator")
+	createdAtKey = []byte("created_at")
+	codecKey     = []byte("codec")
+	blockSizeKey = []byte("block_size")
+	dedupKey     = []byte("dedup")
 
 	stopError          = errors.New("stop")
-	foundError         = errors.New("file already exist")
-	notFoundError      = errors.New("no such file or directory")
+	foundError         = syscall.EEXIST // recognized by os.IsExist
+	notFoundError      = syscall.ENOENT // recognized by os.IsNotExist
 	unableToReadHeader = errors.New("unable to read the file header")
+	missingBlockError  = errors.New("missing file block")
+	linkDirError       = errors.New("hard link not allowed for directory")
+	invalidRenameError = errors.New("cannot move a directory into itself")
 )
 
-// CreateArchive create an archive raa file
+// CreateArchive create an archive raa file, the meta of the archive is written
+// with the format version, the creator and the default settings
 func CreateArchive(dbFile string) (*Archive, error) {
+	return CreateArchiveWithOptions(dbFile, DefaultArchiveOptions)
+}
+
+// CreateArchiveWithOptions is like CreateArchive but using the given options,
+// nil options are the DefaultArchiveOptions
+func CreateArchiveWithOptions(dbFile string, opts *ArchiveOptions) (*Archive, error) {
+	if opts == nil {
+		opts = DefaultArchiveOptions
+	}
+
+	if opts.ReadOnly {
+		return nil, ReadOnlyErr
+	}
+
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
 	if _, err := os.Stat(dbFile); err == nil {
 		return nil, foundError
 	}
 
-	return newArchive(dbFile)
+	return newArchive(dbFile, true, opts)
 }
 
-// OpenArchive open an archive raa file
+// OpenArchive open an archive raa file, an ArchiveFormatError is returned if
+// the file is not a raa archive or his format is not supported
 func OpenArchive(dbFile string) (*Archive, error) {
+	return OpenArchiveWithOptions(dbFile, DefaultArchiveOptions)
+}
+
+// OpenArchiveReadOnly is like OpenArchive but the archive is opened in
+// read-only mode with a shared lock, so many processes can read the same
+// archive at a time. Any write fails with ReadOnlyErr.
+func OpenArchiveReadOnly(dbFile string) (*Archive, error) {
+	opts := *DefaultArchiveOptions
+	opts.ReadOnly = true
+
+	return OpenArchiveWithOptions(dbFile, &opts)
+}
+
+// OpenArchiveWithOptions is like OpenArchive but using the given options, nil
+// options are the DefaultArchiveOptions
+func OpenArchiveWithOptions(dbFile string, opts *ArchiveOptions) (*Archive, error) {
+	if opts == nil {
+		opts = DefaultArchiveOptions
+	}
+
 	if _, err := os.Stat(dbFile); err != nil {
 		return nil, notFoundError
 	}
 
-	return newArchive(dbFile)
+	return newArchive(dbFile, false, opts)
 }
 
-func newArchive(dbFile string) (*Archive, error) {
-	db, err := bolt.Open(dbFile, 0600, &bolt.Options{MinMmapSize: 2})
+func newArchive(dbFile string, create bool, opts *ArchiveOptions) (*Archive, error) {
+	db, err := bolt.Open(dbFile, opts.mode(), &bolt.Options{
+		Timeout:     opts.Timeout,
+		MinMmapSize: opts.MmapSize,
+		NoGrowSync:  opts.NoGrowSync,
+		ReadOnly:    opts.ReadOnly,
+	})
+	if err == bolt.ErrInvalid {
+		return nil, &ArchiveFormatError{Path: dbFile}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	db.NoSync = opts.NoSync
+	a := &Archive{
+		path:      "/",
+		db:        db,
+		codec:     opts.codec(),
+		blockSize: opts.blockSize(),
+		readOnly:  opts.ReadOnly,
+		umask:     opts.Umask.Perm(),
+	}
+
+	if create {
+		err = a.initMeta()
+	}
+
+	if err == nil {
+		err = a.readMeta()
+	}
+
+	if err == nil && !opts.ReadOnly {
+		err = a.sweepPending()
+	}
+
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	return &Archive{path: "/", db: db}, nil
+	return a, nil
+}
+
+// initMeta writes the meta of a new archive
+func (a *Archive) initMeta() error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		return putMeta(tx, a.codec, a.blockSize)
+	})
+}
+
+// putMeta writes the meta of an archive in the current format, with the given
+// default codec and block size
+func putMeta(tx *bolt.Tx, codec CodecId, blockSize int32) error {
+	b, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+
+	format := make([]byte, 4)
+	binary.BigEndian.PutUint32(format, FormatVersion)
+
+	createdAt := make([]byte, 8)
+	binary.BigEndian.PutUint64(createdAt, uint64(time.Now().UnixNano()))
+
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(blockSize))
+
+	meta := map[string][]byte{
+		string(magicKey):     ArchiveMagic,
+		string(formatKey):    format,
+		string(creatorKey):   []byte(Creator),
+		string(createdAtKey): createdAt,
+		string(codecKey):     {byte(codec)},
+		string(blockSizeKey): size,
+	}
+
+	for k, v := range meta {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readMeta validates the archive and reads his settings
+func (a *Archive) readMeta() error {
+	return a.db.View(func(tx *bolt.Tx) error {
+		a.format = archiveFormat(tx)
+		if a.format != FormatVersion {
+			return &ArchiveFormatError{Path: a.db.Path(), Version: a.format}
+		}
+
+		b := tx.Bucket(metaBucket)
+
+		a.creator = string(b.Get(creatorKey))
+		if v := b.Get(createdAtKey); len(v) == 8 {
+			a.createdAt = time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+		}
+
+		if v := b.Get(codecKey); len(v) == 1 {
+			a.codec = CodecId(v[0])
+		}
+
+		if v := b.Get(blockSizeKey); len(v) == 4 {
+			a.blockSize = int32(binary.BigEndian.Uint32(v))
+		}
+
+		if v := b.Get(dedupKey); len(v) == 1 {
+			a.dedup = v[0] == 1
+		}
+
+		if v := b.Get(kdfKey); v != nil {
+			var err error
+			if a.kdf, err = parseKdfParams(v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// archiveFormat returns the format version of the archive, 0 if is not a raa
+// archive. The archives written before the meta was introduced have no meta
+// but a root bucket holding a bucket per file, these are the version 1.
+func archiveFormat(tx *bolt.Tx) uint32 {
+	b := tx.Bucket(metaBucket)
+	if b == nil {
+		if isBaselineArchive(tx) {
+			return 1
+		}
+
+		return 0
+	}
+
+	if !bytes.Equal(b.Get(magicKey), ArchiveMagic) {
+		return 0
+	}
+
+	if v := b.Get(formatKey); len(v) == 4 {
+		return binary.BigEndian.Uint32(v)
+	}
+
+	return 0
+}
+
+func (a *Archive) writeMeta(key, value []byte) error {
+	return a.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(key, value)
+	})
+}
+
+// Format returns the format version of the archive
+func (a *Archive) Format() uint32 {
+	return a.format
+}
+
+// Creator returns the name and version of the tool that created the archive
+func (a *Archive) Creator() string {
+	return a.creator
+}
+
+// CreatedAt returns the creation time of the archive
+func (a *Archive) CreatedAt() time.Time {
+	return a.createdAt
+}
+
+// Codec returns the default codec used to compress the blocks of new files
+func (a *Archive) Codec() CodecId {
+	return a.codec
+}
+
+// SetCodec changes the default codec used to compress the blocks of the files,
+// the codec is stored in the archive. The blocks already written keep the
+// codec used to write them.
+func (a *Archive) SetCodec(id CodecId) error {
+	if _, err := GetCodec(id); err != nil {
+		return err
+	}
+
+	if err := a.writeMeta(codecKey, []byte{byte(id)}); err != nil {
+		return err
+	}
+
+	a.codec = id
+	return nil
+}
+
+// BlockSize returns the default block size of the new files
+func (a *Archive) BlockSize() int32 {
+	return a.blockSize
+}
+
+// SetBlockSize changes the default block size of the new files, the size is
+// stored in the archive. Existing files keep the block size used to write them.
+func (a *Archive) SetBlockSize(size int32) error {
+	if size <= 0 {
+		return InvalidBlockSizeErr
+	}
+
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(size))
+	if err := a.writeMeta(blockSizeKey, v); err != nil {
+		return err
+	}
+
+	a.blockSize = size
+	return nil
+}
+
+// Dedup returns true if the deduplication of blocks is enabled
+func (a *Archive) Dedup() bool {
+	return a.dedup
+}
+
+// SetDedup enables or disables the deduplication of blocks, when enabled the
+// blocks are keyed by the hash of his content and shared between files. The
+// blocks already written are not deduplicated.
+func (a *Archive) SetDedup(enabled bool) error {
+	v := []byte{0}
+	if enabled {
+		v[0] = 1
+	}
+
+	if err := a.writeMeta(dedupKey, v); err != nil {
+		return err
+	}
+
+	a.dedup = enabled
+	return nil
 }
 
 // Path returns the path to currently open volume file.
@@ -58,6 +401,11 @@ func (a *Archive) Path() string {
 	return a.db.Path()
 }
 
+// ReadOnly returns true if the archive was opened with OpenArchiveReadOnly
+func (a *Archive) ReadOnly() bool {
+	return a.readOnly
+}
+
 // Chdir changes the current working directory to the named directory.
 func (a *Archive) Chdir(dir string) error {
 	dir = filepath.Clean(dir)
@@ -95,7 +443,18 @@ func (a *Archive) Chown(name string, uid, gid int) error {
 	return f.Close()
 }
 
-//func Chtimes(name string, atime time.Time, mtime time.Time) error
+// Chtimes changes the access and modification times of the named file,
+// similar to the Unix utime() or utimes() functions.
+// If there is an error, it will be of type *PathError.
+func (a *Archive) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	f, err := a.Open(name)
+	if err != nil {
+		return err
+	}
+
+	f.Chtimes(atime, mtime)
+	return f.Close()
+}
 
 // Getwd returns a rooted path name corresponding to the
 // current directory.
@@ -104,184 +463,480 @@ func (a *Archive) Getwd() (dir string, err error) {
 }
 
 //func IsPermission(err error) bool
-//func Lchown(name string, uid, gid int) error
-//func Link(oldname, newname string) error
-//func Mkdir(name string, perm FileMode) error
-//func MkdirAll(path string, perm FileMode) error
-//func Readlink(name string) (string, error)
 
-// Remove removes the named file or directory.
+// Lchown changes the numeric uid and gid of the named file. If the file is a
+// symbolic link, it changes the uid and gid of the link itself.
 // If there is an error, it will be of type *PathError.
-func (a *Archive) Remove(name string) error {
-	fname := a.getFullpath(name)
-	key := []byte(fname)
-	return a.iterateKeys(func(b *bolt.Bucket, k, v []byte) error {
-		if bytes.Equal(k, key) {
-			if err := b.DeleteBucket(k); err != nil {
-				return err
-			}
+func (a *Archive) Lchown(name string, uid, gid int) error {
+	fname, err := a.resolve(name, false)
+	if err != nil {
+		return &os.PathError{"lchown", name, err}
+	}
 
-			return stopError
-		}
+	f, err := a.openFile(name, fname, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
 
-		return nil
-	})
+	f.Chown(uid, gid)
+	return f.Close()
 }
 
-// RemoveAll removes path and any children it contains.
-// It removes everything it can but returns the first error
-// it encounters.  If the path does not exist, RemoveAll
-// returns nil (no error).
-func (a *Archive) RemoveAll(path string) error {
-	fname := a.getFullpath(path)
-	key := []byte(fname)
-	keySlash := []byte(filepath.Join(path, "/") + "/")
-	return a.iterateKeys(func(b *bolt.Bucket, k, v []byte) error {
-		if bytes.Equal(k, key) || bytes.HasPrefix(k, keySlash) {
-			if err := b.DeleteBucket(k); err != nil {
-				return err
-			}
+// Link creates newname as a hard link to the oldname file, both names share
+// the same inode and blocks.
+// If there is an error, it will be of type *LinkError.
+func (a *Archive) Link(oldname, newname string) error {
+	oldpath, err := a.resolve(oldname, false)
+	if err != nil {
+		return &os.LinkError{"link", oldname, newname, err}
+	}
+
+	newpath, err := a.resolve(newname, false)
+	if err != nil {
+		return &os.LinkError{"link", oldname, newname, err}
+	}
+
+	err = a.update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(rootBucket)
+		if root == nil {
+			return notFoundError
+		}
 
-			return stopError
+		id := root.Get([]byte(oldpath))
+		file := getInodeBucket(tx, id)
+		if file == nil {
+			return notFoundError
 		}
 
-		return nil
-	})
-}
+		if root.Get([]byte(newpath)) != nil {
+			return foundError
+		}
+
+		if err := checkParentKeys(tx, newpath); err != nil {
+			return err
+		}
 
-func (a *Archive) iterateKeys(cb func(b *bolt.Bucket, k, v []byte) error) error {
-	err := a.db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(rootBucket)
+		i, err := getInode(file)
 		if err != nil {
 			return err
 		}
 
-		b.ForEach(func(k, v []byte) error {
-			return cb(b, k, v)
-		})
+		if i.Mode.IsDir() {
+			return linkDirError
+		}
 
-		return nil
+		i.Links++
+		i.ChangedAt = time.Now()
+		if err := putInode(file, i); err != nil {
+			return err
+		}
+
+		return root.Put([]byte(newpath), id)
 	})
 
-	if err == stopError {
-		return nil
+	if err != nil {
+		return &os.LinkError{"link", oldname, newname, err}
 	}
 
-	return err
+	return nil
 }
 
-// Rename renames (moves) a file.
-func (a *Archive) Rename(oldpath, newpath string) error {
-	oldpath = a.getFullpath(oldpath)
-	newpath = a.getFullpath(newpath)
+// Mkdir creates a new directory with the specified name and permission bits.
+// The parent directory must exist.
+// If there is an error, it will be of type *PathError.
+func (a *Archive) Mkdir(name string, perm os.FileMode) error {
+	fname := a.getFullpath(name)
 
-	src, err := a.Open(oldpath)
+	parent, err := a.Stat(filepath.Dir(fname))
 	if err != nil {
-		return err
+		return &os.PathError{"mkdir", name, notFoundError}
 	}
 
-	dst, err := a.OpenFile(newpath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, src.inode.Mode)
-	if err != nil {
-		return err
+	if !parent.IsDir() {
+		return &os.PathError{"mkdir", name, NotDirectoryErr}
 	}
 
-	defer dst.Close()
-	defer a.Remove(oldpath)
+	flag := os.O_RDONLY | os.O_CREATE | os.O_EXCL
+	f, err := a.OpenFile(fname, flag, os.ModeDir|perm.Perm())
+	if err != nil {
+		return &os.PathError{"mkdir", name, err.(*os.PathError).Err}
+	}
 
-	_, err = io.Copy(dst, src)
-	return err
+	return f.Close()
 }
 
-//func SameFile(fi1, fi2 FileInfo) bool
-//func Symlink(oldname, newname string) error
+// MkdirAll creates a directory named path, along with any necessary parents,
+// and returns nil, or else returns an error. The permission bits perm are used
+// for all directories that MkdirAll creates. If path is already a directory,
+// MkdirAll does nothing and returns nil.
+func (a *Archive) MkdirAll(path string, perm os.FileMode) error {
+	fname := a.getFullpath(path)
+	if fi, err := a.Stat(fname); err == nil {
+		if fi.IsDir() {
+			return nil
+		}
 
-// Truncate changes the size of the named file.
-// If there is an error, it will be of type *PathError.
-func (a *Archive) Truncate(name string, size int64) error {
-	f, err := a.Open(name)
-	if err != nil {
+		return &os.PathError{"mkdir", path, NotDirectoryErr}
+	}
+
+	if err := a.MkdirAll(filepath.Dir(fname), perm); err != nil {
 		return err
 	}
 
-	f.Truncate(size)
-	return f.Close()
+	return a.Mkdir(fname, perm)
 }
 
-// OpenFile is the generalized open call; most users will use Open
-// or Create instead.  It opens the named file with specified flag
-// (O_RDONLY etc.) and perm, (0666 etc.) if applicable.  If successful,
-// methods on the returned File can be used for I/O.
+// Readlink returns the destination of the named symbolic link.
 // If there is an error, it will be of type *PathError.
-func (a *Archive) OpenFile(name string, flag int, perm os.FileMode) (file *File, err error) {
-	//TODO: Implement O_APPEND
-	fname := a.getFullpath(name)
-
-	f := newFile(a, fname, flag, perm)
-	if flag&os.O_TRUNC != 0 {
-		//We dont read the file if should be truncated
-		return f, nil
+func (a *Archive) Readlink(name string) (string, error) {
+	fname, err := a.resolve(name, false)
+	if err != nil {
+		return "", &os.PathError{"readlink", name, err}
 	}
 
-	if err := a.readFile(f, []byte(fname)); err != nil {
-		switch err {
-		case notFoundError:
-			if flag&os.O_CREATE != 0 {
-				err = nil
-			}
-		case foundError:
-			if flag&os.O_EXCL == 0 {
-				err = nil
-			}
+	var link string
+	err = a.view(func(tx *bolt.Tx) error {
+		file := getFile(tx, []byte(fname))
+		if file == nil {
+			return notFoundError
 		}
 
+		i, err := getInode(file)
 		if err != nil {
-			return nil, &os.PathError{"open", name, err}
+			return err
+		}
+
+		if i.Mode&os.ModeSymlink == 0 {
+			return NotSymlinkErr
 		}
+
+		link, err = a.readLink(tx, file, i)
+		return err
+	})
+
+	if err != nil {
+		return "", &os.PathError{"readlink", name, err}
 	}
 
-	return f, nil
+	return link, nil
 }
 
-func (a *Archive) readFile(f *File, name []byte) error {
-	return a.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(rootBucket)
-		if b == nil {
+// Remove removes the named file or directory, directories must be empty.
+// If there is an error, it will be of type *PathError.
+func (a *Archive) Remove(name string) error {
+	fname, err := a.resolve(name, false)
+	if err != nil {
+		return &os.PathError{"remove", name, err}
+	}
+
+	err = a.update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(rootBucket)
+		if root == nil {
 			return notFoundError
 		}
 
-		blocks := b.Bucket(name)
-		if blocks == nil {
-			return notFoundError
+		_, isDir, err := lookupName(tx, fname)
+		if err != nil {
+			return err
 		}
 
-		blocks.ForEach(func(k, v []byte) error {
-			if bytes.Equal(k, BlockInode) {
-				buf := bytes.NewBuffer(v)
-				if err := f.inode.Read(buf); err != nil {
-					if err == io.EOF {
-						return notFoundError
-					}
+		if isDir && hasChildrenKeys(root, fname) {
+			return NotEmptyErr
+		}
 
-					return err
-				}
+		return deleteFile(tx, []byte(fname))
+	})
 
-				return nil
-			}
+	if err != nil {
+		return &os.PathError{"remove", name, err}
+	}
 
-			dec, err := snappy.Decode(nil, v)
-			if err != nil {
-				return err
-			}
+	return nil
+}
+
+// RemoveAll removes path and any children it contains, in a single
+// transaction, and returns the number of names removed. Symbolic links are
+// removed not followed. If the path does not exist, RemoveAll returns 0 and
+// nil (no error). If there is an error, it will be of type *PathError.
+func (a *Archive) RemoveAll(path string) (int, error) {
+	fname, err := a.resolve(path, false)
+	if err != nil {
+		return 0, &os.PathError{"removeall", path, err}
+	}
+
+	var count int
+	err = a.update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(rootBucket)
+		if root == nil {
+			return nil
+		}
 
-			buf := bytes.NewBuffer(dec)
-			if _, err := io.Copy(f.buf, buf); err != nil {
+		var keys [][]byte
+		if root.Get([]byte(fname)) != nil {
+			keys = append(keys, []byte(fname))
+		}
+
+		prefix := []byte(dirPrefix(fname))
+		c := root.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+
+		for _, k := range keys {
+			if err := deleteFile(tx, k); err != nil {
 				return err
 			}
+		}
 
-			return nil
-		})
+		count = len(keys)
+		return nil
+	})
 
-		return foundError
+	if err != nil {
+		return 0, &os.PathError{"removeall", path, err}
+	}
+
+	return count, nil
+}
+
+// Rename renames (moves) oldpath to newpath, in a single transaction and
+// without copying the content, only the names are moved. Symbolic links are
+// renamed not followed. Renaming a directory moves all his descendants.
+//
+// If newpath already exists it is replaced, following the POSIX rules: a
+// directory can only replace an empty directory and a file can not replace a
+// directory. If both paths are links to the same file nothing is done.
+// If there is an error, it will be of type *LinkError.
+func (a *Archive) Rename(oldpath, newpath string) error {
+	oldname, err := a.resolve(oldpath, false)
+	if err != nil {
+		return &os.LinkError{"rename", oldpath, newpath, err}
+	}
+
+	newname, err := a.resolve(newpath, false)
+	if err != nil {
+		return &os.LinkError{"rename", oldpath, newpath, err}
+	}
+
+	err = a.update(func(tx *bolt.Tx) error {
+		return renameFile(tx, oldname, newname)
+	})
+
+	if err != nil {
+		return &os.LinkError{"rename", oldpath, newpath, err}
+	}
+
+	return nil
+}
+
+// SameFile reports whether fi1 and fi2 describe the same file, the hard links
+// of a file share the inode id. Only works with the FileInfo returned by
+// this package.
+func SameFile(fi1, fi2 os.FileInfo) bool {
+	a, ok1 := fi1.(*FileInfo)
+	b, ok2 := fi2.(*FileInfo)
+	if !ok1 || !ok2 {
+		return false
+	}
+
+	return a.inode.Id != 0 && a.inode.Id == b.inode.Id
+}
+
+// Symlink creates newname as a symbolic link to oldname, the link is stored
+// as the content of the file.
+// If there is an error, it will be of type *PathError.
+func (a *Archive) Symlink(oldname, newname string) error {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	f, err := a.OpenFile(newname, flag, os.ModeSymlink|0777)
+	if err != nil {
+		return &os.PathError{"symlink", newname, err.(*os.PathError).Err}
+	}
+
+	if _, err := f.WriteString(oldname); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Truncate changes the size of the named file.
+// If there is an error, it will be of type *PathError.
+func (a *Archive) Truncate(name string, size int64) error {
+	f, err := a.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// OpenFile is the generalized open call; most users will use Open
+// or Create instead.  It opens the named file with specified flag
+// (O_RDONLY etc.) and perm, (0666 etc.) if applicable.  If successful,
+// methods on the returned File can be used for I/O. Symbolic links are
+// followed, except when O_CREATE and O_EXCL are given.
+// If there is an error, it will be of type *PathError.
+func (a *Archive) OpenFile(name string, flag int, perm os.FileMode) (file *File, err error) {
+	fname, err := a.resolve(name, flag&os.O_EXCL == 0)
+	if err != nil {
+		return nil, &os.PathError{"open", name, err}
+	}
+
+	return a.openFile(name, fname, flag, perm)
+}
+
+// openFile opens the file at the already resolved fname
+func (a *Archive) openFile(name, fname string, flag int, perm os.FileMode) (*File, error) {
+	if a.isReadOnly() && flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, &os.PathError{"open", name, ReadOnlyErr}
+	}
+
+	if perm&os.ModeSymlink == 0 {
+		perm &^= a.umask
+	}
+
+	f := newFile(a, fname, flag, perm)
+	checkBlocks := flag&os.O_TRUNC == 0
+	if err := a.readInode(&f.inode, []byte(fname), checkBlocks); err != nil {
+		switch err {
+		case notFoundError:
+			if flag&os.O_CREATE != 0 {
+				f.isDirty = true
+				err = a.checkParent(fname)
+			}
+		case foundError:
+			switch {
+			case flag&os.O_EXCL != 0:
+			case f.inode.Mode.IsDir() && f.isWritable:
+				err = IsDirectoryErr
+			default:
+				err = nil
+			}
+		}
+
+		if err != nil {
+			return nil, &os.PathError{"open", name, err}
+		}
+	}
+
+	if flag&os.O_TRUNC != 0 && f.isWritable {
+		f.inode.Size = 0
+		f.modified()
+	}
+
+	return f, nil
+}
+
+// hasInodeBlocks returns true if the block count of the inode matches his size
+// and the last block of his index, the holes at the index are reported when
+// the missing block is read
+func hasInodeBlocks(file *bolt.Bucket, i *Inode) bool {
+	if i.Blocks != i.blockCount() {
+		return false
+	}
+
+	var last []byte
+	if index := file.Bucket(indexBucket); index != nil {
+		last, _ = index.Cursor().Last()
+	}
+
+	if last == nil {
+		return i.Blocks == 0
+	}
+
+	return i.Blocks != 0 && binary.BigEndian.Uint64(last) == i.Blocks-1
+}
+
+// readBlock returns the decoded content of the block n from the given inode
+func (a *Archive) readBlock(inode uint64, n int) ([]byte, error) {
+	var block []byte
+	err := a.view(func(tx *bolt.Tx) error {
+		file := getInodeBucket(tx, inodeKey(inode))
+		if file == nil {
+			return notFoundError
+		}
+
+		id := getBlockId(file, n)
+		if id == nil {
+			return missingBlockError
+		}
+
+		var err error
+		block, err = a.getBlock(tx, id, inode, n)
+		return err
+	})
+
+	return block, err
+}
+
+// readStagedBlock returns the decoded content of the block n by his id, even
+// if the block is not yet referenced by any file
+func (a *Archive) readStagedBlock(id []byte, inode uint64, n int) ([]byte, error) {
+	var block []byte
+	err := a.view(func(tx *bolt.Tx) error {
+		var err error
+		block, err = a.getBlock(tx, id, inode, n)
+		return err
+	})
+
+	return block, err
+}
+
+// stageBlock stores the block n of the file without referencing it from the
+// file, the block becomes part of the file when the file is synced. Any
+// previously staged version of the same block is deleted. The block is
+// recorded as pending until then, see sweepPending. New files reserve their
+// inode id with the first staged block.
+func (a *Archive) stageBlock(f *File, n int) ([]byte, error) {
+	var id []byte
+	inode := f.blockInode()
+	err := a.update(func(tx *bolt.Tx) error {
+		var err error
+		if inode == 0 {
+			if inode, err = reserveInode(tx); err != nil {
+				return err
+			}
+		}
+
+		id, err = a.putBlock(tx, f.dirty[n], inode, n, f.inode.Codec, f.dedup)
+		if err != nil {
+			return err
+		}
+
+		if err := addPending(tx, id, 1); err != nil {
+			return err
+		}
+
+		return deleteStagedBlock(tx, f.staged[n])
+	})
+
+	if err == nil && f.inode.Id == 0 {
+		f.newId = inode
+	}
+
+	return id, err
+}
+
+// releaseBlocks deletes staged blocks that never got referenced by a file
+func (a *Archive) releaseBlocks(ids ...[]byte) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return a.update(func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			if err := deleteStagedBlock(tx, id); err != nil {
+				return err
+			}
+		}
+
+		return nil
 	})
 }
 
@@ -303,15 +958,29 @@ func (a *Archive) Create(name string) (file *File, err error) {
 }
 
 //func Pipe() (r *File, w *File, err error)
-//func Lstat(name string) (fi FileInfo, err error)
+
+// Lstat returns a FileInfo describing the named file. If the file is a
+// symbolic link, the returned FileInfo describes the symbolic link. Lstat
+// makes no attempt to follow the link.
+// If there is an error, it will be of type *PathError.
+func (a *Archive) Lstat(name string) (os.FileInfo, error) {
+	return a.stat(name, false)
+}
 
 // Stat returns a FileInfo describing the named file.
 // If there is an error, it will be of type *PathError.
 func (a *Archive) Stat(name string) (os.FileInfo, error) {
-	fname := a.getFullpath(name)
+	return a.stat(name, true)
+}
+
+func (a *Archive) stat(name string, follow bool) (os.FileInfo, error) {
+	fname, err := a.resolve(name, follow)
+	if err != nil {
+		return nil, &os.PathError{"stat", name, err}
+	}
 
 	i := &Inode{}
-	err := a.readInode(i, []byte(fname))
+	err = a.readInode(i, []byte(fname), false)
 	if err != nil && err != foundError {
 		return nil, &os.PathError{"stat", fname, err}
 	}
@@ -319,19 +988,29 @@ func (a *Archive) Stat(name string) (os.FileInfo, error) {
 	return &FileInfo{fname, *i}, nil
 }
 
-func (a *Archive) readInode(i *Inode, name []byte) error {
-	return a.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(rootBucket)
-		if b == nil {
-			return notFoundError
-		}
+// readInode reads the inode of the named file, foundError is returned on
+// success. The directories without entry get implicitDirInode. If checkBlocks
+// is true, WrongInodeBlocks is returned if the block index of the file does
+// not match the inode, see hasInodeBlocks.
+func (a *Archive) readInode(i *Inode, name []byte, checkBlocks bool) error {
+	if string(name) == "/" {
+		*i = implicitDirInode
+		return foundError
+	}
 
-		blocks := b.Bucket(name)
-		if blocks == nil {
-			return notFoundError
+	return a.view(func(tx *bolt.Tx) error {
+		file := getFile(tx, name)
+		if file == nil {
+			root := tx.Bucket(rootBucket)
+			if root == nil || !hasChildrenKeys(root, string(name)) {
+				return notFoundError
+			}
+
+			*i = implicitDirInode
+			return foundError
 		}
 
-		buf := bytes.NewBuffer(blocks.Get(BlockInode))
+		buf := bytes.NewBuffer(file.Get(inodeEntry))
 		if err := i.Read(buf); err != nil {
 			if err == io.EOF {
 				return notFoundError
@@ -340,14 +1019,224 @@ func (a *Archive) readInode(i *Inode, name []byte) error {
 			return err
 		}
 
+		if checkBlocks && !hasInodeBlocks(file, i) {
+			return WrongInodeBlocks
+		}
+
 		return foundError
 	})
 }
 
+// resolve returns the full path of the named file, with the symbolic links
+// found at his components replaced by his destination. The last component is
+// only followed if follow is true.
+func (a *Archive) resolve(name string, follow bool) (string, error) {
+	fname := a.getFullpath(name)
+	if !follow {
+		if fname == "/" {
+			return fname, nil
+		}
+
+		dir, err := a.resolve(filepath.Dir(fname), true)
+		if err != nil {
+			return "", err
+		}
+
+		return filepath.Join(dir, filepath.Base(fname)), nil
+	}
+
+	for links := 0; links < MaxSymlinks; links++ {
+		target, isLink, err := a.followLink(fname)
+		if err != nil || !isLink {
+			return fname, err
+		}
+
+		fname = target
+	}
+
+	return "", SymlinkLoopErr
+}
+
+// followLink looks for the first symbolic link on the components of the given
+// full path, and returns the path with the link replaced by his destination
+func (a *Archive) followLink(name string) (string, bool, error) {
+	var target string
+	err := a.view(func(tx *bolt.Tx) error {
+		for i := 1; i <= len(name); i++ {
+			if i < len(name) && name[i] != '/' {
+				continue
+			}
+
+			file := getFile(tx, []byte(name[:i]))
+			if file == nil {
+				continue
+			}
+
+			inode, err := getInode(file)
+			if err != nil {
+				return err
+			}
+
+			if inode.Mode&os.ModeSymlink == 0 {
+				continue
+			}
+
+			link, err := a.readLink(tx, file, inode)
+			if err != nil {
+				return err
+			}
+
+			if !filepath.IsAbs(link) {
+				link = filepath.Join(filepath.Dir(name[:i]), link)
+			}
+
+			target = filepath.Join(link, name[i:])
+			return nil
+		}
+
+		return nil
+	})
+
+	return target, target != "", err
+}
+
+// readLink returns the destination of a symbolic link, stored as his content
+func (a *Archive) readLink(tx *bolt.Tx, file *bolt.Bucket, i *Inode) (string, error) {
+	var link []byte
+	for n := 0; int64(len(link)) < i.Size; n++ {
+		id := getBlockId(file, n)
+		if id == nil {
+			return "", missingBlockError
+		}
+
+		block, err := a.getBlock(tx, id, i.Id, n)
+		if err != nil {
+			return "", err
+		}
+
+		link = append(link, block...)
+	}
+
+	return string(link[:i.Size]), nil
+}
+
+// checkParent returns NotDirectoryErr if the closest existing ancestor of the
+// named file is not a directory, the missing ancestors are implicit
+// directories
+func (a *Archive) checkParent(name string) error {
+	return a.view(func(tx *bolt.Tx) error {
+		return checkParentKeys(tx, name)
+	})
+}
+
+func checkParentKeys(tx *bolt.Tx, name string) error {
+	root := tx.Bucket(rootBucket)
+	if root == nil {
+		return nil
+	}
+
+	for dir := filepath.Dir(name); dir != "/"; dir = filepath.Dir(dir) {
+		id := root.Get([]byte(dir))
+		if id == nil {
+			continue
+		}
+
+		file := getInodeBucket(tx, id)
+		if file == nil {
+			return notFoundError
+		}
+
+		i, err := getInode(file)
+		if err != nil {
+			return err
+		}
+
+		if !i.Mode.IsDir() {
+			return NotDirectoryErr
+		}
+
+		return nil
+	}
+
+	return nil
+}
+
+// hasChildren returns true if any file is contained by the named directory
+func (a *Archive) hasChildren(name string) bool {
+	var found bool
+	a.view(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(rootBucket); b != nil {
+			found = hasChildrenKeys(b, name)
+		}
+
+		return nil
+	})
+
+	return found
+}
+
+// readDir returns the immediate children of the named directory, sorted by
+// name. The directories without entry get implicitDirInode.
+func (a *Archive) readDir(name string) ([]os.FileInfo, error) {
+	r := make([]os.FileInfo, 0)
+	prefix := []byte(dirPrefix(name))
+
+	err := a.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(rootBucket)
+		if b == nil {
+			return nil
+		}
+
+		seen := make(map[string]bool, 0)
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			child := string(k[len(prefix):])
+			implicit := false
+			if i := strings.Index(child, "/"); i != -1 {
+				child, implicit = child[:i], true
+			}
+
+			if child == "" || seen[child] {
+				continue
+			}
+
+			seen[child] = true
+			fi := &FileInfo{name: string(prefix) + child, inode: implicitDirInode}
+			if !implicit {
+				file := getInodeBucket(tx, v)
+				if file == nil {
+					return notFoundError
+				}
+
+				i, err := getInode(file)
+				if err != nil {
+					return err
+				}
+
+				fi.inode = *i
+			}
+
+			r = append(r, fi)
+		}
+
+		return nil
+	})
+
+	return r, err
+}
+
+func dirPrefix(name string) string {
+	if name == "/" {
+		return name
+	}
+
+	return name + "/"
+}
+
 // Find return the names of the files matching with the function matcher
 func (a *Archive) Find(matcher func(string) bool) []string {
 	r := make([]string, 0)
-	a.db.View(func(tx *bolt.Tx) error {
+	a.view(func(tx *bolt.Tx) error {
 		b := tx.Bucket(rootBucket)
 		c := b.Cursor()
 
@@ -369,70 +1258,501 @@ func (a *Archive) Close() error {
 	return a.db.Close()
 }
 
-const BlockPattern = "block.%d"
-
-var BlockInode = []byte("block.inode")
-
+// writeFile stores the inode and makes visible the blocks modified since the
+// last sync, in a single transaction, readers never see a half-written file.
+// New files get an inode id from the archive sequence, or the one reserved
+// when staging, unless the name was taken meanwhile by another file, then his
+// inode is reused and the staged blocks are bound again to it.
 func (a *Archive) writeFile(f *File) error {
-	return a.db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(rootBucket)
+	var taken error
+	inode := f.inode
+	err := a.update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(rootBucket)
 		if err != nil {
 			return err
 		}
 
-		blocks, err := b.CreateBucketIfNotExists([]byte(f.name))
+		inodes, err := tx.CreateBucketIfNotExists(inodesBucket)
 		if err != nil {
 			return err
 		}
 
-		buf := bytes.NewBuffer(nil)
-		if err := f.inode.Write(buf); err != nil {
+		// the new files get his name, the existing ones keep the inode even
+		// if were renamed while open, if were removed the changes are lost
+		if inode.Id == 0 {
+			id, isDir, err := lookupName(tx, f.name)
+			switch {
+			case err == notFoundError:
+				if inode.Id = f.newId; inode.Id == 0 {
+					if inode.Id, err = reserveInode(tx); err != nil {
+						return err
+					}
+				}
+
+				if err := root.Put([]byte(f.name), inodeKey(inode.Id)); err != nil {
+					return err
+				}
+			case err != nil:
+				return err
+			case isDir:
+				taken = IsDirectoryErr
+				return discardBlocks(tx, f)
+			default:
+				inode.Id = binary.BigEndian.Uint64(id)
+				if err := a.rebindBlocks(tx, f, inode.Id); err != nil {
+					return err
+				}
+			}
+		} else if inodes.Bucket(inodeKey(inode.Id)) == nil {
+			return discardBlocks(tx, f)
+		}
+
+		file, err := inodes.CreateBucketIfNotExists(inodeKey(inode.Id))
+		if err != nil {
 			return err
 		}
 
-		if err := blocks.Put(BlockInode, buf.Bytes()); err != nil {
+		// the links may be created after the file was opened, and the content
+		// may be written by other handle, the not writable handles only
+		// change the mode, the owner and the times
+		if current, err := getInode(file); err == nil {
+			inode.Links = current.Links
+			if !f.isWritable {
+				inode = mergeInodeMeta(*current, &inode)
+			}
+		}
+
+		if f.isWritable {
+			inode.Blocks = inode.blockCount()
+		}
+
+		if err := putInode(file, &inode); err != nil {
 			return err
 		}
 
-		if err = a.writeFileBlocks(blocks, f); err != nil {
+		if err := writeXattrs(file, f.xattrs); err != nil {
 			return err
 		}
 
-		return nil
+		if !f.isWritable {
+			return nil
+		}
+
+		return a.writeFileBlocks(file, f, &inode)
 	})
+
+	if err != nil {
+		return err
+	}
+
+	if taken != nil {
+		f.staged = make(map[int][]byte, 0)
+		return taken
+	}
+
+	f.inode = inode
+	return nil
 }
 
-func (a *Archive) writeFileBlocks(b *bolt.Bucket, f *File) error {
-	r := bytes.NewReader(f.buf.Bytes())
-	current := 0
-	next := true
-	for next {
-		buf := bytes.NewBuffer(nil)
-		if _, err := io.CopyN(buf, r, int64(f.inode.BlockSize)); err != nil {
-			if err == io.EOF {
-				next = false
-			} else {
+// mergeInodeMeta returns the stored inode with the mode, the owner and the
+// times of the given one
+func mergeInodeMeta(stored Inode, i *Inode) Inode {
+	stored.Mode = i.Mode
+	stored.UserId = i.UserId
+	stored.GroupId = i.GroupId
+	stored.ModifcatedAt = i.ModifcatedAt
+	stored.ChangedAt = i.ChangedAt
+	stored.AccessedAt = i.AccessedAt
+
+	return stored
+}
+
+// writeFileBlocks stores the blocks still in memory and points the file
+// block index to them and to the already staged blocks, the blocks being
+// replaced are deleted. The index is reconciled with the block count of the
+// file, the blocks past it, left by a larger version of the file, are deleted.
+func (a *Archive) writeFileBlocks(file *bolt.Bucket, f *File, i *Inode) error {
+	tx := file.Tx()
+	count := i.Blocks
+
+	blocks := make(map[int][]byte, len(f.staged)+len(f.dirty))
+	for n, id := range f.staged {
+		if err := addPending(tx, id, -1); err != nil {
+			return err
+		}
+
+		if uint64(n) >= count {
+			if err := deleteBlock(tx, id); err != nil {
 				return err
 			}
+
+			continue
 		}
 
-		name := fmt.Sprintf(BlockPattern, current)
-		enc, err := snappy.Encode(nil, buf.Bytes())
+		blocks[n] = id
+	}
+
+	for n, block := range f.dirty {
+		if uint64(n) >= count {
+			continue
+		}
+
+		id, err := a.putBlock(tx, block, i.Id, n, f.inode.Codec, f.dedup)
+		if err != nil {
+			return err
+		}
+
+		if err := deleteBlock(tx, blocks[n]); err != nil {
+			return err
+		}
+
+		blocks[n] = id
+	}
+
+	index, err := file.CreateBucketIfNotExists(indexBucket)
+	if err != nil {
+		return err
+	}
+
+	for n, id := range blocks {
+		key := blockKey(n)
+		if err := deleteBlock(tx, index.Get(key)); err != nil {
+			return err
+		}
+
+		if err := index.Put(key, id); err != nil {
+			return err
+		}
+	}
+
+	return truncateIndex(index, count)
+}
+
+// discardBlocks deletes the blocks staged by a file that can not be written
+func discardBlocks(tx *bolt.Tx, f *File) error {
+	for _, id := range f.staged {
+		if err := deleteStagedBlock(tx, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rebindBlocks encrypts again the blocks staged by a new file, bound to the
+// inode id reserved by the file, binding them to the given inode
+func (a *Archive) rebindBlocks(tx *bolt.Tx, f *File, inode uint64) error {
+	if a.aead == nil {
+		return nil
+	}
+
+	b := tx.Bucket(blocksBucket)
+	for n, id := range f.staged {
+		if isSharedBlock(id) {
+			continue
+		}
+
+		block, err := a.getBlock(tx, id, f.newId, n)
 		if err != nil {
 			return err
 		}
 
-		if err := b.Put([]byte(name), enc); err != nil {
+		enc, err := encodeBlock(block, f.inode.Codec, a.aead, blockAD(id, inode, n))
+		if err != nil {
 			return err
 		}
 
-		current++
-		buf.Reset()
+		if err := b.Put(id, enc); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// reserveInode returns a new inode id from the archive sequence
+func reserveInode(tx *bolt.Tx) (uint64, error) {
+	inodes, err := tx.CreateBucketIfNotExists(inodesBucket)
+	if err != nil {
+		return 0, err
+	}
+
+	return inodes.NextSequence()
+}
+
+// truncateIndex deletes the blocks of the index from the block n onwards
+func truncateIndex(index *bolt.Bucket, n uint64) error {
+	var keys [][]byte
+	c := index.Cursor()
+	for k, v := c.Seek(blockKey(int(n))); k != nil; k, v = c.Next() {
+		if err := deleteBlock(index.Tx(), v); err != nil {
+			return err
+		}
+
+		keys = append(keys, append([]byte(nil), k...))
+	}
+
+	for _, k := range keys {
+		if err := index.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteFile unlinks the named file, the inode and the blocks referenced by
+// it are deleted with his last link
+func deleteFile(tx *bolt.Tx, name []byte) error {
+	root := tx.Bucket(rootBucket)
+	id := append([]byte(nil), root.Get(name)...)
+	if len(id) == 0 {
+		return notFoundError
+	}
+
+	if err := root.Delete(name); err != nil {
+		return err
+	}
+
+	file := getInodeBucket(tx, id)
+	if file == nil {
+		return nil
+	}
+
+	i, err := getInode(file)
+	if err != nil {
+		return err
+	}
+
+	if i.Links > 1 {
+		i.Links--
+		i.ChangedAt = time.Now()
+		return putInode(file, i)
+	}
+
+	if index := file.Bucket(indexBucket); index != nil {
+		err := index.ForEach(func(k, v []byte) error {
+			return deleteBlock(tx, v)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket(inodesBucket).DeleteBucket(id)
+}
+
+// renameFile moves the name oldname, and any name under it, to newname,
+// replacing newname if exists
+func renameFile(tx *bolt.Tx, oldname, newname string) error {
+	if oldname == newname {
+		return nil
+	}
+
+	if oldname == "/" || newname == "/" || strings.HasPrefix(newname, dirPrefix(oldname)) {
+		return invalidRenameError
+	}
+
+	root, err := tx.CreateBucketIfNotExists(rootBucket)
+	if err != nil {
+		return err
+	}
+
+	if err := checkParentKeys(tx, newname); err != nil {
+		return err
+	}
+
+	src, srcDir, err := lookupName(tx, oldname)
+	if err != nil {
+		return err
+	}
+
+	dst, dstDir, err := lookupName(tx, newname)
+	switch {
+	case err == notFoundError:
+	case err != nil:
+		return err
+	case src != nil && dst != nil && bytes.Equal(src, dst):
+		return nil
+	case srcDir && !dstDir:
+		return NotDirectoryErr
+	case !srcDir && dstDir:
+		return IsDirectoryErr
+	case dstDir && hasChildrenKeys(root, newname):
+		return NotEmptyErr
+	case dst != nil:
+		if err := deleteFile(tx, []byte(newname)); err != nil {
+			return err
+		}
+	}
+
+	if src != nil {
+		if err := root.Put([]byte(newname), src); err != nil {
+			return err
+		}
+
+		if err := root.Delete([]byte(oldname)); err != nil {
+			return err
+		}
+
+		if err := touchInode(tx, src); err != nil {
+			return err
+		}
+	}
+
+	if !srcDir {
+		return nil
+	}
+
+	prefix := []byte(dirPrefix(oldname))
+
+	var keys, ids [][]byte
+	c := root.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+		ids = append(ids, append([]byte(nil), v...))
+	}
+
+	for n, k := range keys {
+		name := append([]byte(dirPrefix(newname)), k[len(prefix):]...)
+		if err := root.Put(name, ids[n]); err != nil {
+			return err
+		}
+
+		if err := root.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lookupName returns the inode id of the named file, and if is a directory,
+// the directories without entry but with children have a nil id
+func lookupName(tx *bolt.Tx, name string) ([]byte, bool, error) {
+	root := tx.Bucket(rootBucket)
+	id := root.Get([]byte(name))
+	if id == nil {
+		if hasChildrenKeys(root, name) {
+			return nil, true, nil
+		}
+
+		return nil, false, notFoundError
+	}
+
+	file := getInodeBucket(tx, id)
+	if file == nil {
+		return nil, false, notFoundError
+	}
+
+	i, err := getInode(file)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return append([]byte(nil), id...), i.Mode.IsDir(), nil
+}
+
+// hasChildrenKeys returns true if any name is under the named directory
+func hasChildrenKeys(root *bolt.Bucket, name string) bool {
+	prefix := []byte(dirPrefix(name))
+	k, _ := root.Cursor().Seek(prefix)
+
+	return k != nil && bytes.HasPrefix(k, prefix)
+}
+
+// touchInode updates the change time of the inode with the given id
+func touchInode(tx *bolt.Tx, id []byte) error {
+	file := getInodeBucket(tx, id)
+	if file == nil {
+		return nil
+	}
+
+	i, err := getInode(file)
+	if err != nil {
+		return err
+	}
+
+	i.ChangedAt = time.Now()
+	return putInode(file, i)
+}
+
+// getFile returns the bucket holding the inode, the block index and the
+// extended attributes of the named file, nil if the file does not exist.
+//
+// The bucket of a file has the following layout:
+// - inode: the byte representation of the Inode
+// - index: bucket with the ids of the blocks, keyed by blockKey
+// - xattrs: bucket with the extended attributes, keyed by name
+func getFile(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	root := tx.Bucket(rootBucket)
+	if root == nil {
+		return nil
+	}
+
+	return getInodeBucket(tx, root.Get(name))
+}
+
+// getInodeBucket returns the bucket of the inode with the given id
+func getInodeBucket(tx *bolt.Tx, id []byte) *bolt.Bucket {
+	inodes := tx.Bucket(inodesBucket)
+	if inodes == nil || id == nil {
+		return nil
+	}
+
+	return inodes.Bucket(id)
+}
+
+func getInode(file *bolt.Bucket) (*Inode, error) {
+	i := &Inode{}
+	if err := i.Read(bytes.NewBuffer(file.Get(inodeEntry))); err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
+
+func putInode(file *bolt.Bucket, i *Inode) error {
+	buf := bytes.NewBuffer(nil)
+	if err := i.Write(buf); err != nil {
+		return err
+	}
+
+	return file.Put(inodeEntry, buf.Bytes())
+}
+
+// getBlockId returns the id of the block n of the file, nil if the file has
+// no such block
+func getBlockId(file *bolt.Bucket, n int) []byte {
+	index := file.Bucket(indexBucket)
+	if index == nil {
+		return nil
+	}
+
+	return index.Get(blockKey(n))
+}
+
+// blockKey returns the key of the block n at the block index of a file, a
+// fixed-width BigEndian number, so the keys are sorted by position
+func blockKey(n int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(n))
+
+	return key
+}
+
+func inodeKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+
+	return key
+}
+
 func (a *Archive) getFullpath(name string) string {
-	return filepath.Join(a.path + name)
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(a.path, name)
+	}
+
+	return filepath.Clean(name)
 }
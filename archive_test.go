@@ -6,7 +6,9 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/mcuadros/bolt"
 	. "gopkg.in/check.v1"
 )
 
@@ -40,6 +42,81 @@ func (s *FSSuite) TestOpenArchive(c *C) {
 	c.Assert(err, Equals, notFoundError)
 }
 
+func (s *FSSuite) TestOpenArchive_Meta(c *C) {
+	s.a.Close()
+
+	a, err := OpenArchive(s.file)
+	c.Assert(err, IsNil)
+	c.Assert(a.Format(), Equals, FormatVersion)
+	c.Assert(a.Creator(), Equals, Creator)
+	c.Assert(time.Since(a.CreatedAt()) < time.Minute, Equals, true)
+	c.Assert(a.Codec(), Equals, DefaultCodec)
+	c.Assert(a.BlockSize(), Equals, DefaultBlockSize)
+	s.a = a
+}
+
+func (s *FSSuite) TestOpenArchive_NotRaa(c *C) {
+	file := filepath.Join(filepath.Dir(s.file), "foo.db")
+	db, err := bolt.Open(file, 0600, nil)
+	c.Assert(err, IsNil)
+	db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("foo"))
+		return err
+	})
+	db.Close()
+
+	_, err = OpenArchive(file)
+	c.Assert(err, DeepEquals, &ArchiveFormatError{Path: file})
+	c.Assert(err.Error(), Equals, file+": not a raa archive")
+
+	ioutil.WriteFile(file, []byte(strings.Repeat("foo", 4096)), 0600)
+	_, err = OpenArchive(file)
+	c.Assert(err, FitsTypeOf, &ArchiveFormatError{})
+}
+
+func (s *FSSuite) TestOpenArchive_UnsupportedFormat(c *C) {
+	s.a.writeMeta(formatKey, []byte{0, 0, 0, 42})
+	s.a.Close()
+
+	_, err := OpenArchive(s.file)
+	c.Assert(err, DeepEquals, &ArchiveFormatError{Path: s.file, Version: 42})
+
+	s.a, _ = CreateArchive(s.file + ".new")
+}
+
+func (s *FSSuite) TestOpenArchiveReadOnly(c *C) {
+	f, _ := s.a.Create("/foo")
+	f.WriteString("foo")
+	f.Close()
+	s.a.Close()
+
+	a, err := OpenArchiveReadOnly(s.file)
+	c.Assert(err, IsNil)
+	c.Assert(a.ReadOnly(), Equals, true)
+
+	b, err := OpenArchiveReadOnly(s.file)
+	c.Assert(err, IsNil)
+	defer b.Close()
+
+	f, err = b.Open("/foo")
+	c.Assert(err, IsNil)
+	c.Assert(f.String(), Equals, "foo")
+	c.Assert(f.Close(), IsNil)
+
+	_, err = a.Create("/bar")
+	c.Assert(err.(*os.PathError).Err, Equals, ReadOnlyErr)
+
+	_, err = a.OpenFile("/foo", os.O_WRONLY, 0)
+	c.Assert(err.(*os.PathError).Err, Equals, ReadOnlyErr)
+
+	c.Assert(a.Remove("/foo").(*os.PathError).Err, Equals, ReadOnlyErr)
+	c.Assert(a.Chmod("/foo", 0600), Equals, ReadOnlyErr)
+	c.Assert(a.SetCodec(NoneCodec), Equals, ReadOnlyErr)
+	c.Assert(a.Update(func(*Tx) error { return nil }), Equals, ReadOnlyErr)
+
+	s.a = a
+}
+
 func (s *FSSuite) TestPath(c *C) {
 	c.Assert(s.a.Path(), Equals, s.file)
 }
@@ -80,6 +157,26 @@ func (s *FSSuite) TestArchive_Chmod(c *C) {
 	c.Assert(int(f.inode.Mode), Equals, 0042)
 }
 
+func (s *FSSuite) TestArchive_ChmodWhileWritten(c *C) {
+	f, _ := s.a.Create("foo")
+	f.WriteString("foo")
+	c.Assert(f.Close(), IsNil)
+
+	r, _ := s.a.Open("foo")
+
+	w, _ := s.a.OpenFile("foo", os.O_WRONLY|os.O_APPEND, 0)
+	w.WriteString("bar")
+	c.Assert(w.Close(), IsNil)
+
+	c.Assert(r.Chmod(0600), IsNil)
+	c.Assert(r.Close(), IsNil)
+
+	f, err := s.a.Open("foo")
+	c.Assert(err, IsNil)
+	c.Assert(f.String(), Equals, "foobar")
+	c.Assert(int(f.inode.Mode), Equals, 0600)
+}
+
 func (s *FSSuite) TestArchive_Chown(c *C) {
 	f, _ := s.a.Create("foo")
 	f.WriteString("foo")
@@ -96,6 +193,24 @@ func (s *FSSuite) TestArchive_Chown(c *C) {
 	c.Assert(f.inode.GroupId, Equals, uint64(84))
 }
 
+func (s *FSSuite) TestArchive_Chtimes(c *C) {
+	f, _ := s.a.Create("foo")
+	f.Close()
+
+	atime := time.Unix(42, 84)
+	mtime := time.Unix(1429202449, 123456789)
+	c.Assert(s.a.Chtimes("foo", atime, mtime), IsNil)
+
+	fi, err := s.a.Stat("foo")
+	c.Assert(err, IsNil)
+	c.Assert(fi.ModTime().Equal(mtime), Equals, true)
+	c.Assert(fi.Sys().(Inode).AccessedAt.Equal(atime), Equals, true)
+	c.Assert(fi.Sys().(Inode).ChangedAt.After(mtime), Equals, true)
+
+	err = s.a.Chtimes("bar", atime, mtime)
+	c.Assert(err, FitsTypeOf, &os.PathError{})
+}
+
 func (s *FSSuite) TestArchive_Rename(c *C) {
 	f, _ := s.a.Create("foo")
 	f.WriteString("foo")
@@ -107,7 +222,7 @@ func (s *FSSuite) TestArchive_Rename(c *C) {
 	f, err = s.a.Open("bar")
 	c.Assert(err, IsNil)
 	c.Assert(f.Name(), Equals, "/bar")
-	c.Assert(f.buf.Len(), Equals, 3)
+	c.Assert(f.String(), Equals, "foo")
 
 	_, err = s.a.Stat("foo")
 	c.Assert(err, Not(IsNil))
@@ -115,13 +230,112 @@ func (s *FSSuite) TestArchive_Rename(c *C) {
 
 func (s *FSSuite) TestArchive_RenameExists(c *C) {
 	f, _ := s.a.Create("foo")
+	f.WriteString("foo")
 	f.Close()
 
 	f, _ = s.a.Create("bar")
+	f.WriteString("bar")
 	f.Close()
 
 	err := s.a.Rename("/foo", "/bar")
-	c.Assert(err, Not(IsNil))
+	c.Assert(err, IsNil)
+
+	f, _ = s.a.Open("/bar")
+	c.Assert(f.String(), Equals, "foo")
+
+	stats, _ := s.a.BlockStats()
+	c.Assert(stats.Stored, Equals, int64(1))
+}
+
+func (s *FSSuite) TestArchive_RenameRules(c *C) {
+	f, _ := s.a.Create("/foo")
+	f.Close()
+	c.Assert(s.a.MkdirAll("/bar/qux", 0755), IsNil)
+	c.Assert(s.a.Mkdir("/empty", 0755), IsNil)
+
+	err := s.a.Rename("/foo", "/bar")
+	c.Assert(err.(*os.LinkError).Err, Equals, IsDirectoryErr)
+
+	err = s.a.Rename("/bar", "/foo")
+	c.Assert(err.(*os.LinkError).Err, Equals, NotDirectoryErr)
+
+	err = s.a.Rename("/empty", "/bar")
+	c.Assert(err.(*os.LinkError).Err, Equals, NotEmptyErr)
+
+	err = s.a.Rename("/bar", "/bar/qux/baz")
+	c.Assert(err, FitsTypeOf, &os.LinkError{})
+
+	err = s.a.Rename("/missing", "/baz")
+	c.Assert(err, FitsTypeOf, &os.LinkError{})
+
+	err = s.a.Rename("/empty", "/foo/empty")
+	c.Assert(err.(*os.LinkError).Err, Equals, NotDirectoryErr)
+
+	c.Assert(s.a.Rename("/bar", "/empty"), IsNil)
+
+	fi, err := s.a.Stat("/empty/qux")
+	c.Assert(err, IsNil)
+	c.Assert(fi.IsDir(), Equals, true)
+
+	c.Assert(s.a.Link("/foo", "/baz"), IsNil)
+	c.Assert(s.a.Rename("/foo", "/baz"), IsNil)
+	c.Assert(s.a.Find(func(string) bool { return true }), DeepEquals, []string{
+		"/baz", "/empty", "/empty/qux", "/foo",
+	})
+}
+
+func (s *FSSuite) TestArchive_RenameDir(c *C) {
+	c.Assert(s.a.MkdirAll("/foo/bar", 0755), IsNil)
+
+	f, _ := s.a.Create("/foo/bar/qux")
+	f.WriteString("qux")
+	f.Close()
+
+	f, _ = s.a.Create("/foobar")
+	f.Close()
+
+	c.Assert(s.a.Rename("/foo", "/baz"), IsNil)
+	c.Assert(s.a.Find(func(string) bool { return true }), DeepEquals, []string{
+		"/baz", "/baz/bar", "/baz/bar/qux", "/foobar",
+	})
+
+	f, err := s.a.Open("/baz/bar/qux")
+	c.Assert(err, IsNil)
+	c.Assert(f.String(), Equals, "qux")
+}
+
+func (s *FSSuite) TestArchive_RenameOpenFile(c *C) {
+	f, _ := s.a.Create("/foo")
+	f.WriteString("foo")
+	f.Sync()
+
+	c.Assert(s.a.Rename("/foo", "/bar"), IsNil)
+
+	f.WriteString("bar")
+	c.Assert(f.Close(), IsNil)
+
+	_, err := s.a.Stat("/foo")
+	c.Assert(err, NotNil)
+
+	f, _ = s.a.Open("/bar")
+	c.Assert(f.String(), Equals, "foobar")
+}
+
+func (s *FSSuite) TestArchive_RemoveOpenFile(c *C) {
+	f, _ := s.a.Create("/foo")
+	f.WriteString("foo")
+	f.Sync()
+
+	c.Assert(s.a.Remove("/foo"), IsNil)
+
+	f.WriteString("bar")
+	c.Assert(f.Close(), IsNil)
+
+	_, err := s.a.Stat("/foo")
+	c.Assert(err, NotNil)
+
+	stats, _ := s.a.BlockStats()
+	c.Assert(stats.Stored, Equals, int64(0))
 }
 
 func (s *FSSuite) TestArchive_Truncate(c *C) {
@@ -133,13 +347,14 @@ func (s *FSSuite) TestArchive_Truncate(c *C) {
 	c.Assert(err, IsNil)
 
 	f, _ = s.a.OpenFile("foo", os.O_RDONLY, 0)
-	c.Assert(f.buf.Len(), Equals, 1)
+	c.Assert(f.inode.Size, Equals, int64(1))
+	c.Assert(f.String(), Equals, "f")
 }
 
 func (s *FSSuite) TestArchive_Open(c *C) {
 	f, err := s.a.Create("foo")
 	c.Assert(err, IsNil)
-	c.Assert(f.buf.Len(), Equals, 0)
+	c.Assert(f.dirty, HasLen, 0)
 
 	f.Write([]byte("foo"))
 	f.Close()
@@ -147,13 +362,14 @@ func (s *FSSuite) TestArchive_Open(c *C) {
 	f, err = s.a.Open("foo")
 	c.Assert(err, IsNil)
 	c.Assert(f.Name(), Equals, "/foo")
-	c.Assert(f.buf.Len(), Equals, 3)
+	c.Assert(f.block, IsNil)
+	c.Assert(f.String(), Equals, "foo")
 }
 
 func (s *FSSuite) TestArchive_OpenFile(c *C) {
 	f, err := s.a.OpenFile("foo", os.O_EXCL|os.O_CREATE, 0)
 	c.Assert(err, IsNil)
-	c.Assert(f.buf.Len(), Equals, 0)
+	c.Assert(f.dirty, HasLen, 0)
 
 	f.Write([]byte("foo"))
 	f.Close()
@@ -165,7 +381,7 @@ func (s *FSSuite) TestArchive_OpenFile(c *C) {
 func (s *FSSuite) TestArchive_Create(c *C) {
 	f, err := s.a.Create("foo")
 	c.Assert(err, IsNil)
-	c.Assert(f.buf.Len(), Equals, 0)
+	c.Assert(f.dirty, HasLen, 0)
 
 	f.Write([]byte("foo"))
 	f.Close()
@@ -174,7 +390,7 @@ func (s *FSSuite) TestArchive_Create(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(f.Name(), Equals, "/foo")
 	c.Assert(f.inode.Size, Equals, int64(0))
-	c.Assert(f.buf.Len(), Equals, 0)
+	c.Assert(f.dirty, HasLen, 0)
 }
 
 func (s *FSSuite) TestArchive_Stat(c *C) {
@@ -205,39 +421,421 @@ func (s *FSSuite) TestArchive_Remove(c *C) {
 }
 
 func (s *FSSuite) TestArchive_RemoveAll(c *C) {
-	f, _ := s.a.Create("foo")
+	c.Assert(s.a.Mkdir("foo", 0755), IsNil)
+
+	f, _ := s.a.Create("foobar")
 	f.Write([]byte("foo"))
 	f.Close()
 
-	f, _ = s.a.Create("foobar")
+	f, _ = s.a.Create("foo/bar")
 	f.Write([]byte("foo"))
 	f.Close()
 
-	f, _ = s.a.Create("foo/bar")
+	f, _ = s.a.Create("foo/qux/bar")
 	f.Write([]byte("foo"))
 	f.Close()
 
-	err := s.a.RemoveAll("foo")
+	n, err := s.a.RemoveAll("foo")
 	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
 
 	f, err = s.a.Open("foo")
-	c.Assert(err, Not(IsNil))
+	c.Assert(os.IsNotExist(err), Equals, true)
 
 	f, err = s.a.Open("foobar")
 	c.Assert(err, IsNil)
-	c.Assert(f.buf.Len(), Equals, 3)
+	c.Assert(f.String(), Equals, "foo")
+
+	_, err = s.a.Open("foo/bar")
+	c.Assert(os.IsNotExist(err), Equals, true)
 
-	f, err = s.a.Open("foo/bar")
+	stats, _ := s.a.BlockStats()
+	c.Assert(stats.Stored, Equals, int64(1))
+
+	n, err = s.a.RemoveAll("foo")
 	c.Assert(err, IsNil)
-	c.Assert(f.buf.Len(), Equals, 3)
+	c.Assert(n, Equals, 0)
 }
 
-func (s *FSSuite) TestArchive_Find(c *C) {
+func (s *FSSuite) TestArchive_RemoveNotExist(c *C) {
+	err := s.a.Remove("/foo")
+	c.Assert(err, FitsTypeOf, &os.PathError{})
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	_, err = s.a.Stat("/foo")
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *FSSuite) TestArchive_RemoveDir(c *C) {
+	c.Assert(s.a.MkdirAll("/foo/bar", 0700), IsNil)
+
+	err := s.a.Remove("/foo")
+	c.Assert(err.(*os.PathError).Err, Equals, NotEmptyErr)
+
+	c.Assert(s.a.Remove("/foo/bar"), IsNil)
+	c.Assert(s.a.Remove("/foo"), IsNil)
+
+	_, err = s.a.Stat("/foo")
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *FSSuite) TestArchive_Mkdir(c *C) {
+	err := s.a.Mkdir("foo", 0700)
+	c.Assert(err, IsNil)
+
+	fi, err := s.a.Stat("foo")
+	c.Assert(err, IsNil)
+	c.Assert(fi.IsDir(), Equals, true)
+	c.Assert(fi.Mode(), Equals, os.ModeDir|0700)
+
+	err = s.a.Mkdir("foo", 0700)
+	c.Assert(err, FitsTypeOf, &os.PathError{})
+
+	err = s.a.Mkdir("bar/baz", 0700)
+	c.Assert(err, FitsTypeOf, &os.PathError{})
+
+	f, _ := s.a.Create("qux")
+	f.Close()
+
+	err = s.a.Mkdir("qux/baz", 0700)
+	c.Assert(err.(*os.PathError).Err, Equals, NotDirectoryErr)
+}
+
+func (s *FSSuite) TestArchive_MkdirAll(c *C) {
+	err := s.a.MkdirAll("/foo/bar/baz", 0750)
+	c.Assert(err, IsNil)
+
+	for _, name := range []string{"/foo", "/foo/bar", "/foo/bar/baz"} {
+		fi, err := s.a.Stat(name)
+		c.Assert(err, IsNil)
+		c.Assert(fi.Mode(), Equals, os.ModeDir|0750)
+	}
+
+	c.Assert(s.a.MkdirAll("/foo/bar", 0700), IsNil)
+
+	f, _ := s.a.Create("/foo/qux")
+	f.Close()
+
+	err = s.a.MkdirAll("/foo/qux/baz", 0700)
+	c.Assert(err, FitsTypeOf, &os.PathError{})
+}
+
+func (s *FSSuite) TestArchive_OpenDir(c *C) {
+	c.Assert(s.a.Mkdir("foo", 0700), IsNil)
+
+	_, err := s.a.Create("foo")
+	c.Assert(err.(*os.PathError).Err, Equals, IsDirectoryErr)
+
+	f, err := s.a.Open("foo")
+	c.Assert(err, IsNil)
+
+	_, err = f.Read(make([]byte, 1))
+	c.Assert(err.(*os.PathError).Err, Equals, IsDirectoryErr)
+
+	fi, err := s.a.Stat("/")
+	c.Assert(err, IsNil)
+	c.Assert(fi.IsDir(), Equals, true)
+}
+
+func (s *FSSuite) TestArchive_ImplicitDir(c *C) {
+	f, _ := s.a.Create("/foo/bar/qux")
+	c.Assert(f.Close(), IsNil)
+
+	fi, err := s.a.Stat("/foo")
+	c.Assert(err, IsNil)
+	c.Assert(fi.IsDir(), Equals, true)
+
+	f, err = s.a.Open("/foo/bar")
+	c.Assert(err, IsNil)
+
+	names, err := f.Readdirnames(0)
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"qux"})
+
+	c.Assert(s.a.Mkdir("/foo/baz", 0755), IsNil)
+
+	_, err = s.a.Create("/foo")
+	c.Assert(err.(*os.PathError).Err, Equals, IsDirectoryErr)
+}
+
+func (s *FSSuite) TestArchive_CreateUnderFile(c *C) {
+	f, _ := s.a.Create("/foo")
+	c.Assert(f.Close(), IsNil)
+
+	_, err := s.a.Create("/foo/bar")
+	c.Assert(err.(*os.PathError).Err, Equals, NotDirectoryErr)
+
+	_, err = s.a.Create("/foo/bar/qux")
+	c.Assert(err.(*os.PathError).Err, Equals, NotDirectoryErr)
+}
+
+func (s *FSSuite) TestArchive_Symlink(c *C) {
+	s.a.Mkdir("/lib", 0755)
+	f, _ := s.a.Create("/lib/lib.so.1")
+	f.WriteString("foo")
+	f.Close()
+
+	c.Assert(s.a.Symlink("lib.so.1", "/lib/lib.so"), IsNil)
+	c.Assert(s.a.Symlink("/lib", "/usr"), IsNil)
+
+	err := s.a.Symlink("lib.so.1", "/lib/lib.so")
+	c.Assert(err, FitsTypeOf, &os.PathError{})
+
+	for _, name := range []string{"/lib/lib.so", "/usr/lib.so", "/usr/lib.so.1"} {
+		f, err := s.a.Open(name)
+		c.Assert(err, IsNil)
+		c.Assert(f.Name(), Equals, "/lib/lib.so.1")
+		c.Assert(f.String(), Equals, "foo")
+	}
+
+	fi, err := s.a.Stat("/usr")
+	c.Assert(err, IsNil)
+	c.Assert(fi.IsDir(), Equals, true)
+}
+
+func (s *FSSuite) TestArchive_SymlinkOverImplicitDir(c *C) {
+	f, _ := s.a.Create("/a/x")
+	c.Assert(f.Close(), IsNil)
+
+	err := s.a.Symlink("../../escape", "/a")
+	c.Assert(os.IsExist(err), Equals, true)
+
+	_, err = s.a.OpenFile("/a", os.O_WRONLY|os.O_CREATE, 0644)
+	c.Assert(err.(*os.PathError).Err, Equals, IsDirectoryErr)
+
+	c.Assert(s.a.Find(func(string) bool { return true }), DeepEquals, []string{"/a/x"})
+}
+
+func (s *FSSuite) TestArchive_SymlinkLoop(c *C) {
+	s.a.Symlink("bar", "/foo")
+	s.a.Symlink("foo", "/bar")
+	s.a.Symlink("qux", "/qux")
+
+	_, err := s.a.Open("/foo")
+	c.Assert(err.(*os.PathError).Err, Equals, SymlinkLoopErr)
+
+	_, err = s.a.Stat("/qux")
+	c.Assert(err.(*os.PathError).Err, Equals, SymlinkLoopErr)
+
+	_, err = s.a.Lstat("/qux")
+	c.Assert(err, IsNil)
+}
+
+func (s *FSSuite) TestArchive_SymlinkDangling(c *C) {
+	s.a.Symlink("bar", "/foo")
+
+	_, err := s.a.Open("/foo")
+	c.Assert(err, FitsTypeOf, &os.PathError{})
+
+	f, err := s.a.Create("/foo")
+	c.Assert(err, IsNil)
+	f.WriteString("bar")
+	f.Close()
+
+	f, err = s.a.Open("/bar")
+	c.Assert(err, IsNil)
+	c.Assert(f.String(), Equals, "bar")
+}
+
+func (s *FSSuite) TestArchive_Lstat(c *C) {
+	f, _ := s.a.Create("/foo")
+	f.WriteString("foo")
+	f.Close()
+
+	s.a.Symlink("foo", "/bar")
+
+	fi, err := s.a.Lstat("/bar")
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode(), Equals, os.ModeSymlink|0777)
+	c.Assert(fi.Size(), Equals, int64(3))
+
+	fi, err = s.a.Stat("/bar")
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode().IsRegular(), Equals, true)
+}
+
+func (s *FSSuite) TestArchive_Readlink(c *C) {
+	s.a.SetBlockSize(2)
+	s.a.Symlink("../foo/bar", "/qux")
+
+	link, err := s.a.Readlink("/qux")
+	c.Assert(err, IsNil)
+	c.Assert(link, Equals, "../foo/bar")
+
+	f, _ := s.a.Create("/foo")
+	f.Close()
+
+	_, err = s.a.Readlink("/foo")
+	c.Assert(err.(*os.PathError).Err, Equals, NotSymlinkErr)
+}
+
+func (s *FSSuite) TestArchive_RemoveSymlink(c *C) {
+	f, _ := s.a.Create("/foo")
+	f.Close()
+
+	s.a.Symlink("foo", "/bar")
+	c.Assert(s.a.Remove("/bar"), IsNil)
+
+	_, err := s.a.Lstat("/bar")
+	c.Assert(err, Not(IsNil))
+
+	_, err = s.a.Stat("/foo")
+	c.Assert(err, IsNil)
+}
+
+func (s *FSSuite) TestArchive_InodeId(c *C) {
+	for _, name := range []string{"/foo", "/bar"} {
+		f, _ := s.a.Create(name)
+		f.WriteString("foo")
+		f.Close()
+	}
+
+	foo, _ := s.a.Stat("/foo")
+	bar, _ := s.a.Stat("/bar")
+	c.Assert(foo.Sys().(Inode).Id, Equals, uint64(1))
+	c.Assert(bar.Sys().(Inode).Id, Equals, uint64(2))
+	c.Assert(SameFile(foo, bar), Equals, false)
+
+	f, _ := s.a.Create("/foo")
+	f.Close()
+
+	foo, _ = s.a.Stat("/foo")
+	c.Assert(foo.Sys().(Inode).Id, Equals, uint64(1))
+}
+
+func (s *FSSuite) TestArchive_CreateTwice(c *C) {
+	f1, _ := s.a.Create("/foo")
+	f2, _ := s.a.Create("/foo")
+
+	f1.WriteString("one")
+	c.Assert(f1.Close(), IsNil)
+
+	f2.WriteString("two")
+	c.Assert(f2.Close(), IsNil)
+
+	f, _ := s.a.Open("/foo")
+	c.Assert(f.String(), Equals, "two")
+	c.Assert(countBlocks(s.a), Equals, 1)
+
+	var inodes int
+	s.a.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(inodesBucket).ForEach(func(k, v []byte) error {
+			inodes++
+			return nil
+		})
+	})
+
+	c.Assert(inodes, Equals, 1)
+
+	f1, _ = s.a.Create("/bar")
+	c.Assert(s.a.Mkdir("/bar", 0755), IsNil)
+
+	f1.WriteString("bar")
+	c.Assert(f1.Close(), Equals, IsDirectoryErr)
+	c.Assert(countBlocks(s.a), Equals, 1)
+}
+
+func (s *FSSuite) TestArchive_Link(c *C) {
+	f, _ := s.a.Create("/foo")
+	f.WriteString("foo")
+	f.Close()
+
+	c.Assert(s.a.Link("/foo", "/bar"), IsNil)
+
+	foo, _ := s.a.Stat("/foo")
+	bar, _ := s.a.Stat("/bar")
+	c.Assert(SameFile(foo, bar), Equals, true)
+	c.Assert(bar.Sys().(Inode).Links, Equals, uint32(2))
+
+	f, _ = s.a.OpenFile("/bar", os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString("bar")
+	f.Close()
+
+	f, _ = s.a.Open("/foo")
+	c.Assert(f.String(), Equals, "foobar")
+
+	c.Assert(s.a.Remove("/foo"), IsNil)
+
+	f, _ = s.a.Open("/bar")
+	c.Assert(f.inode.Links, Equals, uint32(1))
+	c.Assert(f.String(), Equals, "foobar")
+
+	c.Assert(s.a.Remove("/bar"), IsNil)
+	c.Assert(countBlocks(s.a), Equals, 0)
+}
+
+func (s *FSSuite) TestArchive_LinkErrors(c *C) {
+	f, _ := s.a.Create("/foo")
+	f.Close()
+	f, _ = s.a.Create("/bar")
+	f.Close()
+	s.a.Mkdir("/qux", 0755)
+
+	err := s.a.Link("/foo", "/bar")
+	c.Assert(err, FitsTypeOf, &os.LinkError{})
+
+	err = s.a.Link("/baz", "/foo/baz")
+	c.Assert(err, FitsTypeOf, &os.LinkError{})
+
+	err = s.a.Link("/qux", "/baz")
+	c.Assert(err, FitsTypeOf, &os.LinkError{})
+
+	err = s.a.Link("/foo", "/foo/baz")
+	c.Assert(err.(*os.LinkError).Err, Equals, NotDirectoryErr)
+}
+
+func (s *FSSuite) TestArchive_SetCodec(c *C) {
+	c.Assert(s.a.Codec(), Equals, DefaultCodec)
+	c.Assert(s.a.SetCodec(CodecId(42)), Equals, UnknownCodecErr)
+
+	err := s.a.SetCodec(ZstdCodec)
+	c.Assert(err, IsNil)
+	c.Assert(s.a.Codec(), Equals, ZstdCodec)
+
+	s.a.Close()
+	s.a, err = OpenArchive(s.file)
+	c.Assert(err, IsNil)
+	c.Assert(s.a.Codec(), Equals, ZstdCodec)
+
 	f, _ := s.a.Create("foo")
-	f.Write([]byte("foo"))
+	c.Assert(f.inode.Codec, Equals, ZstdCodec)
+}
+
+func (s *FSSuite) TestArchive_SetBlockSize(c *C) {
+	c.Assert(s.a.BlockSize(), Equals, DefaultBlockSize)
+	c.Assert(s.a.SetBlockSize(0), Equals, InvalidBlockSizeErr)
+
+	err := s.a.SetBlockSize(64 * 1024)
+	c.Assert(err, IsNil)
+
+	s.a.Close()
+	s.a, err = OpenArchive(s.file)
+	c.Assert(err, IsNil)
+	c.Assert(s.a.BlockSize(), Equals, int32(64*1024))
+
+	f, _ := s.a.Create("foo")
+	c.Assert(f.inode.BlockSize, Equals, int32(64*1024))
+}
+
+func (s *FSSuite) TestArchive_MixedCodecs(c *C) {
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 3
+	f.WriteString("foo")
+	c.Assert(f.SetCodec(GzipCodec), IsNil)
+	f.WriteString("bar")
+	c.Assert(f.SetCodec(NoneCodec), IsNil)
+	f.WriteString("qux")
+	c.Assert(f.SetCodec(CodecId(42)), FitsTypeOf, &os.PathError{})
 	f.Close()
 
-	f, _ = s.a.Create("foo/qux")
+	f, _ = s.a.Open("foo")
+	c.Assert(f.String(), Equals, "foobarqux")
+}
+
+func (s *FSSuite) TestArchive_Find(c *C) {
+	c.Assert(s.a.Mkdir("foo", 0755), IsNil)
+
+	f, _ := s.a.Create("foo/qux")
 	f.Write([]byte("foo"))
 	f.Close()
 
@@ -0,0 +1,260 @@
+package raa
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/mcuadros/bolt"
+)
+
+// Blocks are stored at the blocks bucket, keyed by an 8-byte sequence id, or
+// when deduplication is enabled by the 32-byte SHA-256 of his content. The
+// deduplicated blocks can be shared between files, the number of references
+// to each one is stored at the refs bucket.
+//
+// The blocks staged by a file, stored before the file is synced, are counted
+// at the pending bucket until the file references them. The blocks left by
+// files never synced, as after a crash, are deleted by sweepPending.
+var (
+	blocksBucket  = []byte("blocks")
+	refsBucket    = []byte("refs")
+	pendingBucket = []byte("pending")
+)
+
+// BlockStats contains stats about the blocks stored in an archive
+type BlockStats struct {
+	// Blocks is the number of blocks referenced by the files
+	Blocks int64
+	// Stored is the number of blocks stored in the archive
+	Stored int64
+	// StoredSize is the size in bytes of the stored blocks
+	StoredSize int64
+	// SavedSize is the size in bytes saved by the deduplication of blocks
+	SavedSize int64
+}
+
+// BlockStats returns stats about the blocks stored in the archive
+func (a *Archive) BlockStats() (*BlockStats, error) {
+	s := &BlockStats{}
+	err := a.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blocksBucket)
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(id, v []byte) error {
+			refs := getRefs(tx, id)
+
+			s.Blocks += refs
+			s.Stored++
+			s.StoredSize += int64(len(v))
+			s.SavedSize += (refs - 1) * int64(len(v))
+
+			return nil
+		})
+	})
+
+	return s, err
+}
+
+// getBlock returns the decoded content of the block with the given id, stored
+// as block n of the file with the given inode.
+func (a *Archive) getBlock(tx *bolt.Tx, id []byte, inode uint64, n int) ([]byte, error) {
+	b := tx.Bucket(blocksBucket)
+	if b == nil {
+		return nil, missingBlockError
+	}
+
+	v := b.Get(id)
+	if v == nil {
+		return nil, missingBlockError
+	}
+
+	return decodeBlock(v, a.kdf != nil, a.aead, blockAD(id, inode, n))
+}
+
+// putBlock stores the content of the block n of the file with the given inode
+// and returns his id, the block is encrypted if the archive is encrypted.
+func (a *Archive) putBlock(tx *bolt.Tx, block []byte, inode uint64, n int, codec CodecId, dedup bool) ([]byte, error) {
+	if a.kdf != nil && a.aead == nil {
+		return nil, LockedArchiveErr
+	}
+
+	b, err := tx.CreateBucketIfNotExists(blocksBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	var id []byte
+	if dedup {
+		id = a.blockHash(block)
+
+		if b.Get(id) != nil {
+			return id, addRefs(tx, id, 1)
+		}
+
+		if err := addRefs(tx, id, 1); err != nil {
+			return nil, err
+		}
+	} else {
+		seq, err := b.NextSequence()
+		if err != nil {
+			return nil, err
+		}
+
+		id = make([]byte, 8)
+		binary.BigEndian.PutUint64(id, seq)
+	}
+
+	enc, err := encodeBlock(block, codec, a.aead, blockAD(id, inode, n))
+	if err != nil {
+		return nil, err
+	}
+
+	return id, b.Put(id, enc)
+}
+
+// blockHash returns the id of a deduplicated block, on encrypted archives a
+// HMAC keyed with a subkey of the archive key is used so the ids do not leak
+// the content of the blocks.
+func (a *Archive) blockHash(block []byte) []byte {
+	h := sha256.New()
+	if a.dedupKey != nil {
+		h = hmac.New(sha256.New, a.dedupKey)
+	}
+
+	h.Write(block)
+	return h.Sum(nil)
+}
+
+// deleteBlock deletes a block, if the block is shared only the reference is
+// released and the block is deleted when no references are left.
+func deleteBlock(tx *bolt.Tx, id []byte) error {
+	if id == nil {
+		return nil
+	}
+
+	b := tx.Bucket(blocksBucket)
+	if b == nil {
+		return nil
+	}
+
+	if isSharedBlock(id) {
+		if err := addRefs(tx, id, -1); err != nil {
+			return err
+		}
+
+		if getRefs(tx, id) > 0 {
+			return nil
+		}
+	}
+
+	return b.Delete(id)
+}
+
+func isSharedBlock(id []byte) bool {
+	return len(id) == sha256.Size
+}
+
+func getRefs(tx *bolt.Tx, id []byte) int64 {
+	if !isSharedBlock(id) {
+		return 1
+	}
+
+	b := tx.Bucket(refsBucket)
+	if b == nil {
+		return 0
+	}
+
+	return getCounter(b, id)
+}
+
+func addRefs(tx *bolt.Tx, id []byte, delta int64) error {
+	b, err := tx.CreateBucketIfNotExists(refsBucket)
+	if err != nil {
+		return err
+	}
+
+	return putCounter(b, id, getRefs(tx, id)+delta)
+}
+
+// addPending changes the number of times the block is staged and not yet
+// referenced by any file
+func addPending(tx *bolt.Tx, id []byte, delta int64) error {
+	if id == nil {
+		return nil
+	}
+
+	b, err := tx.CreateBucketIfNotExists(pendingBucket)
+	if err != nil {
+		return err
+	}
+
+	return putCounter(b, id, getCounter(b, id)+delta)
+}
+
+// deleteStagedBlock deletes a staged block that never got referenced by a file
+func deleteStagedBlock(tx *bolt.Tx, id []byte) error {
+	if err := addPending(tx, id, -1); err != nil {
+		return err
+	}
+
+	return deleteBlock(tx, id)
+}
+
+// sweepPending deletes the blocks staged by files that were never synced,
+// called on open, when no file of the archive can be open
+func (a *Archive) sweepPending() error {
+	var found bool
+	a.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(pendingBucket) != nil
+		return nil
+	})
+
+	if !found {
+		return nil
+	}
+
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pendingBucket)
+
+		var ids [][]byte
+		var counts []int64
+		b.ForEach(func(id, v []byte) error {
+			ids = append(ids, append([]byte(nil), id...))
+			counts = append(counts, getCounter(b, id))
+			return nil
+		})
+
+		for n, id := range ids {
+			for ; counts[n] > 0; counts[n]-- {
+				if err := deleteBlock(tx, id); err != nil {
+					return err
+				}
+			}
+		}
+
+		return tx.DeleteBucket(pendingBucket)
+	})
+}
+
+func getCounter(b *bolt.Bucket, id []byte) int64 {
+	v := b.Get(id)
+	if len(v) != 8 {
+		return 0
+	}
+
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+func putCounter(b *bolt.Bucket, id []byte, count int64) error {
+	if count <= 0 {
+		return b.Delete(id)
+	}
+
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(count))
+
+	return b.Put(id, v)
+}
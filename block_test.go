@@ -0,0 +1,75 @@
+package raa
+
+import (
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *FSSuite) TestBlocks_Dedup(c *C) {
+	c.Assert(s.a.SetDedup(true), IsNil)
+
+	for _, name := range []string{"foo", "bar"} {
+		f, _ := s.a.Create(name)
+		f.inode.BlockSize = 3
+		f.WriteString("quxquxfoo")
+		c.Assert(f.Close(), IsNil)
+	}
+
+	stats, err := s.a.BlockStats()
+	c.Assert(err, IsNil)
+	c.Assert(stats.Blocks, Equals, int64(6))
+	c.Assert(stats.Stored, Equals, int64(2))
+	c.Assert(stats.SavedSize, Equals, stats.StoredSize*2)
+
+	c.Assert(s.a.Remove("foo"), IsNil)
+
+	f, _ := s.a.Open("bar")
+	c.Assert(f.String(), Equals, "quxquxfoo")
+
+	stats, _ = s.a.BlockStats()
+	c.Assert(stats.Blocks, Equals, int64(3))
+	c.Assert(stats.Stored, Equals, int64(2))
+
+	c.Assert(s.a.Remove("bar"), IsNil)
+
+	stats, _ = s.a.BlockStats()
+	c.Assert(stats.Blocks, Equals, int64(0))
+	c.Assert(stats.Stored, Equals, int64(0))
+}
+
+func (s *FSSuite) TestBlocks_DedupRewrite(c *C) {
+	c.Assert(s.a.SetDedup(true), IsNil)
+
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 3
+	f.WriteString("quxqux")
+	c.Assert(f.Close(), IsNil)
+
+	f, _ = s.a.OpenFile("foo", os.O_RDWR, 0)
+	f.WriteAt([]byte("bar"), 3)
+	c.Assert(f.Close(), IsNil)
+
+	f, _ = s.a.Open("foo")
+	c.Assert(f.String(), Equals, "quxbar")
+
+	stats, _ := s.a.BlockStats()
+	c.Assert(stats.Blocks, Equals, int64(2))
+	c.Assert(stats.Stored, Equals, int64(2))
+	c.Assert(stats.SavedSize, Equals, int64(0))
+}
+
+func (s *FSSuite) TestBlocks_Stats(c *C) {
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 3
+	f.WriteString("quxqux")
+	c.Assert(f.Close(), IsNil)
+
+	stats, err := s.a.BlockStats()
+	c.Assert(err, IsNil)
+	c.Assert(stats.Blocks, Equals, int64(2))
+	c.Assert(stats.Stored, Equals, int64(2))
+	c.Assert(stats.SavedSize, Equals, int64(0))
+
+	c.Assert(s.a.Dedup(), Equals, false)
+}
@@ -2,20 +2,30 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/dustin/go-humanize"
 )
 
 type CmdList struct {
 	cmd
+	encryption
 }
 
 func (c *CmdList) Execute(args []string) error {
-	if err := c.buildArchive(); err != nil {
+	if err := c.openArchive(); err != nil {
 		return err
 	}
 
 	defer c.a.Close()
+	if c.a.Encrypted() && !c.encryption.enabled() {
+		return fmt.Errorf("Encrypted archive, please provide a key file or a passphrase")
+	}
+
+	if err := c.encryption.apply(c.a); err != nil {
+		return err
+	}
+
 	if err := c.listVolume(); err != nil {
 		return err
 	}
@@ -24,16 +34,23 @@ func (c *CmdList) Execute(args []string) error {
 }
 
 func (c *CmdList) listVolume() error {
-	for _, file := range c.a.Find(func(string) bool { return true }) {
-		fi, _ := c.a.Stat(file)
+	return c.a.Walk("/", func(file string, fi os.FileInfo, err error) error {
+		if err != nil || file == "/" {
+			return err
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, _ := c.a.Readlink(file)
+			file = file + " -> " + link
+		}
 
 		fmt.Printf("%s %s % 6s %s\n",
-			fi.Mode().Perm(),
+			fi.Mode(),
 			fi.ModTime().Format("Jan 2 15:04"),
 			humanize.Bytes(uint64(fi.Size())),
 			file,
 		)
-	}
 
-	return nil
+		return nil
+	})
 }
@@ -3,13 +3,18 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/mcuadros/go-raa"
 )
 
 type CmdPack struct {
 	cmd
-	Input struct {
+	encryption
+	Codec     string `short:"c" default:"snappy" description:"Codec used to compress the files: none, snappy, deflate, gzip or zstd"`
+	BlockSize int32  `short:"b" description:"Block size in bytes, by default 10MiB"`
+	Dedup     bool   `short:"d" description:"Deduplicates the blocks shared between files"`
+	Input     struct {
 		Files []string `positional-arg-name:"input" description:"files or directories to be add to the archive."`
 	} `positional-args:"yes"`
 }
@@ -35,6 +40,27 @@ func (c *CmdPack) do() error {
 		return err
 	}
 
+	codec, _ := raa.ParseCodec(c.Codec)
+	if err := c.a.SetCodec(codec); err != nil {
+		return err
+	}
+
+	if c.BlockSize != 0 {
+		if err := c.a.SetBlockSize(c.BlockSize); err != nil {
+			return err
+		}
+	}
+
+	if c.Dedup {
+		if err := c.a.SetDedup(true); err != nil {
+			return err
+		}
+	}
+
+	if err := c.encryption.apply(c.a); err != nil {
+		return err
+	}
+
 	if err := c.processInputToVolume(); err != nil {
 		return err
 	}
@@ -55,6 +81,14 @@ func (c *CmdPack) validate() error {
 		return fmt.Errorf("Invalid input count, please add one or more input files/dirs")
 	}
 
+	if _, err := raa.ParseCodec(c.Codec); err != nil {
+		return fmt.Errorf("Invalid codec %q", c.Codec)
+	}
+
+	if c.BlockSize < 0 {
+		return fmt.Errorf("Invalid block size %d", c.BlockSize)
+	}
+
 	return nil
 }
 
@@ -68,7 +102,7 @@ func (c *CmdPack) processInputToVolume() error {
 
 		switch {
 		case fi.Mode().IsRegular():
-			_, err = raa.AddFile(c.a, file, target)
+			_, err = raa.AddFile(c.a, file, filepath.Join(target, fi.Name()))
 		case fi.Mode().IsDir():
 			_, err = raa.AddDirectory(c.a, file, target, true)
 		default:
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 
 	"github.com/mcuadros/go-raa"
@@ -10,11 +11,14 @@ import (
 )
 
 func main() {
+	raa.Creator = "raa " + version
+
 	parser := flags.NewNamedParser("raa", flags.Default)
 	parser.AddCommand("pack", "Create a new archive containing the specified items.", "", &CmdPack{})
 	parser.AddCommand("unpack", "Extract to disk from the archive.", "", &CmdUnpack{})
 	parser.AddCommand("list", "List the items contained on a file.", "", &CmdList{})
 	parser.AddCommand("stats", "Display some stats about the file.", "", &CmdStats{})
+	parser.AddCommand("upgrade", "Rewrite an archive of a previous version to the current format.", "", &CmdUpgrade{})
 	parser.AddCommand("version", "Show the version information.", "", &CmdVersion{})
 
 	_, err := parser.Parse()
@@ -35,6 +39,31 @@ type cmd struct {
 	a *raa.Archive
 }
 
+type encryption struct {
+	KeyFile    string `long:"key-file" description:"File containing the raw 32-byte key of an encrypted archive"`
+	Passphrase string `long:"passphrase" description:"Passphrase of an encrypted archive"`
+}
+
+func (e *encryption) enabled() bool {
+	return e.KeyFile != "" || e.Passphrase != ""
+}
+
+func (e *encryption) apply(a *raa.Archive) error {
+	switch {
+	case e.KeyFile != "":
+		key, err := ioutil.ReadFile(e.KeyFile)
+		if err != nil {
+			return err
+		}
+
+		return a.SetKey(key)
+	case e.Passphrase != "":
+		return a.SetPassphrase([]byte(e.Passphrase))
+	}
+
+	return nil
+}
+
 func (c *cmd) validate() error {
 	if c.Args.File == "" {
 		return fmt.Errorf("Missing raa file, please provide a valid one.")
@@ -51,3 +80,13 @@ func (c *cmd) buildArchive() error {
 	c.a = a
 	return nil
 }
+
+func (c *cmd) openArchive() error {
+	a, err := raa.OpenArchiveReadOnly(c.Args.File)
+	if err != nil {
+		return err
+	}
+
+	c.a = a
+	return nil
+}
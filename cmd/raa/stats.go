@@ -4,20 +4,30 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/dustin/go-humanize"
 )
 
 type CmdStats struct {
 	cmd
+	encryption
 }
 
 func (c *CmdStats) Execute(args []string) error {
-	if err := c.buildArchive(); err != nil {
+	if err := c.openArchive(); err != nil {
 		return err
 	}
 
 	defer c.a.Close()
+	if c.a.Encrypted() && !c.encryption.enabled() {
+		return fmt.Errorf("Encrypted archive, please provide a key file or a passphrase")
+	}
+
+	if err := c.encryption.apply(c.a); err != nil {
+		return err
+	}
+
 	if err := c.displayStats(); err != nil {
 		return err
 	}
@@ -32,6 +42,9 @@ func (c *CmdStats) displayStats() error {
 	tCount := sumMapInt64(count)
 
 	fmt.Println("File:\t\t\t", c.a.Path())
+	fmt.Println("Format version:\t\t", c.a.Format())
+	fmt.Println("Created by:\t\t", c.a.Creator())
+	fmt.Println("Created at:\t\t", c.a.CreatedAt().Format(time.RFC1123))
 
 	fi, err := os.Stat(c.a.Path())
 	if err != nil {
@@ -43,7 +56,17 @@ func (c *CmdStats) displayStats() error {
 	fmt.Println("RAA size:\t\t", humanize.Bytes(uint64(fi.Size())))
 
 	ratio := float64(fi.Size()) / float64(tSize)
-	fmt.Printf("Space saving ratio:\t %.2f%%\n\n", (1-ratio)*100)
+	fmt.Printf("Space saving ratio:\t %.2f%%\n", (1-ratio)*100)
+
+	bs, err := c.a.BlockStats()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Blocks:\t\t\t", bs.Blocks)
+	fmt.Println("Stored blocks:\t\t", bs.Stored)
+	fmt.Println("Dedup saving:\t\t", humanize.Bytes(uint64(bs.SavedSize)))
+	fmt.Println()
 
 	fmt.Printf("%10s %5s %6s %7s\n", "extension", "files", "size", "size %")
 	fmt.Printf("-------------------------------\n")
@@ -63,8 +86,10 @@ func (c *CmdStats) collectStats() (map[string]int64, map[string]int64) {
 	size := make(map[string]int64, 0)
 	count := make(map[string]int64, 0)
 
-	for _, file := range c.a.Find(func(string) bool { return true }) {
-		fi, _ := c.a.Stat(file)
+	c.a.Walk("/", func(file string, fi os.FileInfo, err error) error {
+		if err != nil || file == "/" {
+			return err
+		}
 
 		ext := filepath.Ext(file)
 		if _, ok := size[ext]; !ok {
@@ -77,7 +102,8 @@ func (c *CmdStats) collectStats() (map[string]int64, map[string]int64) {
 		}
 
 		count[ext]++
-	}
+		return nil
+	})
 
 	return size, count
 }
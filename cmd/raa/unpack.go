@@ -6,10 +6,10 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-
-	"github.com/mcuadros/go-raa"
+	"strings"
 
 	"github.com/dustin/go-humanize"
+	"github.com/mcuadros/go-raa"
 )
 
 const writeFlagsDefault = os.O_WRONLY | os.O_CREATE | os.O_TRUNC | os.O_EXCL
@@ -18,6 +18,7 @@ const defaultPerms = 0755
 
 type CmdUnpack struct {
 	cmd
+	encryption
 	Verbose     bool   `short:"v" description:"Activates the verbose mode"`
 	Overwrite   bool   `short:"o" description:"Overwrites the files if arleady exists"`
 	IgnorePerms bool   `short:"i" description:"Ignore files permisisions"`
@@ -41,6 +42,14 @@ func (c *CmdUnpack) Execute(args []string) error {
 		return err
 	}
 
+	if c.a.Encrypted() && !c.encryption.enabled() {
+		return fmt.Errorf("Encrypted archive, please provide a key file or a passphrase")
+	}
+
+	if err := c.encryption.apply(c.a); err != nil {
+		return err
+	}
+
 	if err := c.do(); err != nil {
 		return err
 	}
@@ -82,22 +91,150 @@ func (c *CmdUnpack) validate() error {
 	return nil
 }
 
-func (c *CmdUnpack) openArchive() error {
-	a, err := raa.OpenArchive(c.Args.File)
-	if err != nil {
-		return err
+func (c *CmdUnpack) do() error {
+	var dirs []string
+	links := make(map[uint64]string, 0)
+	for _, fname := range c.a.Find(c.matchingFunc) {
+		fi, err := c.a.Lstat(fname)
+		if err == nil && fi.Mode().IsRegular() && fi.Sys().(raa.Inode).Links > 1 {
+			id := fi.Sys().(raa.Inode).Id
+			if oldname, ok := links[id]; ok {
+				c.extractHardLink(oldname, fname)
+				continue
+			}
+
+			links[id] = fname
+		}
+
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Unable to stat %q: %s\n", fname, err.Error())
+		case fi.IsDir():
+			c.extractDir(fname)
+			dirs = append(dirs, fname)
+		case fi.Mode()&os.ModeSymlink != 0:
+			c.extractSymlink(fname)
+		default:
+			c.extract(fname)
+		}
+	}
+
+	// the permissions and times are applied once the content is written,
+	// from the deepest directory, so read-only directories can be filled
+	for i := len(dirs) - 1; i >= 0; i-- {
+		c.restoreDir(dirs[i])
 	}
 
-	c.a = a
 	return nil
 }
 
-func (c *CmdUnpack) do() error {
-	for _, fname := range c.a.Find(c.matchingFunc) {
-		c.extract(fname)
+func (c *CmdUnpack) restoreDir(srcName string) {
+	fi, err := c.a.Stat(srcName)
+	if err != nil {
+		return
 	}
 
-	return nil
+	dstName, err := c.dstPath(srcName)
+	if err != nil {
+		return
+	}
+
+	if dfi, err := os.Lstat(dstName); err != nil || !dfi.IsDir() {
+		return
+	}
+
+	if !c.IgnorePerms {
+		if err := os.Chmod(dstName, fi.Mode().Perm()); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to chmod dir %q: %s\n", dstName, err.Error())
+		}
+	}
+
+	c.restoreTimes(dstName, fi)
+}
+
+func (c *CmdUnpack) restoreTimes(dstName string, fi os.FileInfo) {
+	inode := fi.Sys().(raa.Inode)
+	if err := os.Chtimes(dstName, inode.AccessedAt, inode.ModifcatedAt); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to change times of %q: %s\n", dstName, err.Error())
+	}
+}
+
+func (c *CmdUnpack) extractDir(srcName string) {
+	dstName, err := c.dstPath(srcName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create dir %q: %s\n", srcName, err.Error())
+		return
+	}
+
+	if err := os.MkdirAll(dstName, defaultPerms); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create dir %q: %s\n", dstName, err.Error())
+		return
+	}
+
+	if c.Verbose {
+		fmt.Println(srcName)
+	}
+}
+
+func (c *CmdUnpack) extractHardLink(oldName, srcName string) {
+	oldDstName := filepath.Join(c.Output.Path, oldName)
+	dstName, err := c.dstPath(srcName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create link %q: %s\n", srcName, err.Error())
+		return
+	}
+
+	dir := filepath.Dir(dstName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create dir %q: %s\n", dir, err.Error())
+		return
+	}
+
+	if c.Overwrite {
+		os.Remove(dstName)
+	}
+
+	if err := os.Link(oldDstName, dstName); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create link %q: %s\n", dstName, err.Error())
+		return
+	}
+
+	if c.Verbose {
+		fmt.Println(srcName, "=>", oldName)
+	}
+}
+
+func (c *CmdUnpack) extractSymlink(srcName string) {
+	link, err := c.a.Readlink(srcName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read link %q: %s\n", srcName, err.Error())
+		return
+	}
+
+	dstName, err := c.dstPath(srcName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create link %q: %s\n", srcName, err.Error())
+		return
+	}
+
+	dir := filepath.Dir(dstName)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create dir %q: %s\n", dir, err.Error())
+		return
+	}
+
+	if c.Overwrite {
+		os.Remove(dstName)
+	}
+
+	if err := os.Symlink(link, dstName); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create link %q: %s\n", dstName, err.Error())
+		return
+	}
+
+	if c.Verbose {
+		fmt.Println(srcName, "->", link)
+	}
 }
 
 func (c *CmdUnpack) extract(srcName string) {
@@ -111,7 +248,12 @@ func (c *CmdUnpack) extract(srcName string) {
 
 	fi, _ := src.Stat()
 
-	dstName := filepath.Join(c.Output.Path, srcName)
+	dstName, err := c.dstPath(srcName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open %q for writing: %s\n", srcName, err.Error())
+		return
+	}
+
 	dir := filepath.Dir(dstName)
 	if err = os.MkdirAll(dir, 0755); err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to create dir %q: %s\n", dir, err.Error())
@@ -136,7 +278,37 @@ func (c *CmdUnpack) extract(srcName string) {
 		return
 	}
 
+	c.restoreTimes(dstName, fi)
+
 	if c.Verbose {
 		fmt.Println(srcName, humanize.Bytes(uint64(fi.Size())))
 	}
 }
+
+// dstPath returns the path where srcName is extracted, the parents already
+// present at the output path must be real directories, so a symbolic link
+// extracted before can not redirect the writes out of the output path
+func (c *CmdUnpack) dstPath(srcName string) (string, error) {
+	dir := c.Output.Path
+	for _, part := range strings.Split(filepath.Dir(srcName), string(filepath.Separator)) {
+		if part == "" {
+			continue
+		}
+
+		dir = filepath.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		if !fi.IsDir() {
+			return "", fmt.Errorf("%q is not a directory", dir)
+		}
+	}
+
+	return filepath.Join(c.Output.Path, srcName), nil
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"github.com/mcuadros/go-raa"
+)
+
+type CmdUpgrade struct {
+	cmd
+}
+
+func (c *CmdUpgrade) Execute(args []string) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	return raa.UpgradeArchive(c.Args.File)
+}
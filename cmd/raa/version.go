@@ -2,9 +2,12 @@ package main
 
 import (
 	"fmt"
+
+	"github.com/mcuadros/go-raa"
 )
 
-var version string
+// version defaults to the version of the package, may be set at build time
+var version = raa.Version
 var build string
 
 type CmdVersion struct{}
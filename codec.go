@@ -0,0 +1,290 @@
+package raa
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+
+	"code.google.com/p/snappy-go/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CodecId identifies the algorithm used to compress a block, the id is stored
+// on every block so an archive can contain blocks with different codecs. The
+// id 0 is reserved, it means no codec was set.
+//
+// Blocks are stored with the following format:
+// - 4-byte CRC32C checksum of the rest of the block, BigEndian
+// - 1-byte codec id, the highest bit is set on encrypted blocks
+// - n-byte encoded content, if encrypted the nonce and the sealed content
+type CodecId uint8
+
+const (
+	NoneCodec CodecId = iota + 1
+	SnappyCodec
+	DeflateCodec
+	GzipCodec
+	ZstdCodec
+)
+
+const DefaultCodec = SnappyCodec
+
+var (
+	UnknownCodecErr = errors.New("unknown block codec")
+	EmptyBlockErr   = errors.New("empty block")
+	ChecksumErr     = errors.New("block checksum mismatch")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+const (
+	blockHeaderLength = 5
+	encryptedFlag     = 0x80
+)
+
+// CorruptBlockError records a block whose checksum does not match his content
+type CorruptBlockError struct {
+	Name  string
+	Block int
+}
+
+func (e *CorruptBlockError) Error() string {
+	return fmt.Sprintf("corrupt block %d of %s: %s", e.Block, e.Name, ChecksumErr)
+}
+
+// Codec compresses and decompresses the content of the blocks
+type Codec interface {
+	Encode(src []byte) ([]byte, error)
+	Decode(src []byte) ([]byte, error)
+}
+
+var codecNames = map[CodecId]string{
+	NoneCodec:    "none",
+	SnappyCodec:  "snappy",
+	DeflateCodec: "deflate",
+	GzipCodec:    "gzip",
+	ZstdCodec:    "zstd",
+}
+
+// String returns the name of the codec
+func (id CodecId) String() string {
+	if name, ok := codecNames[id]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("codec(%d)", id)
+}
+
+// ParseCodec returns the CodecId of a built-in codec by his name
+func ParseCodec(name string) (CodecId, error) {
+	for id, n := range codecNames {
+		if n == name {
+			return id, nil
+		}
+	}
+
+	return 0, UnknownCodecErr
+}
+
+var codecs = map[CodecId]Codec{
+	NoneCodec:    noneCodec{},
+	SnappyCodec:  snappyCodec{},
+	DeflateCodec: deflateCodec{},
+	GzipCodec:    gzipCodec{},
+	ZstdCodec:    newZstdCodec(),
+}
+
+// RegisterCodec makes available a Codec under the given id, replacing any
+// codec previously registered with the same id. The id should be between 1
+// and 127, the id 0 and the highest bit are reserved.
+func RegisterCodec(id CodecId, c Codec) {
+	if id == 0 || id&encryptedFlag != 0 {
+		panic("raa: RegisterCodec id out of range")
+	}
+
+	codecs[id] = c
+}
+
+// GetCodec returns the Codec registered under the given id
+func GetCodec(id CodecId) (Codec, error) {
+	c, ok := codecs[id]
+	if !ok {
+		return nil, UnknownCodecErr
+	}
+
+	return c, nil
+}
+
+// encodeBlock compresses a block using the given codec, the codec id and the
+// checksum are written as header of the result. If aead is not nil the
+// compressed content is encrypted, authenticating also ad.
+func encodeBlock(block []byte, id CodecId, aead cipher.AEAD, ad []byte) ([]byte, error) {
+	c, err := GetCodec(id)
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := c.Encode(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := byte(id)
+	if aead != nil {
+		if enc, err = seal(aead, enc, ad); err != nil {
+			return nil, err
+		}
+
+		header |= encryptedFlag
+	}
+
+	raw := make([]byte, blockHeaderLength+len(enc))
+	raw[4] = header
+	copy(raw[blockHeaderLength:], enc)
+	binary.BigEndian.PutUint32(raw, crc32.Checksum(raw[4:], castagnoli))
+
+	return raw, nil
+}
+
+// decodeBlock verifies the checksum and decompresses a block encoded by
+// encodeBlock, ChecksumErr is returned if the block is corrupted. Encrypted
+// blocks require the aead and ad used to encode them, at an encrypted archive
+// the unencrypted blocks are rejected with DecryptErr.
+func decodeBlock(raw []byte, encrypted bool, aead cipher.AEAD, ad []byte) ([]byte, error) {
+	if len(raw) < blockHeaderLength {
+		return nil, EmptyBlockErr
+	}
+
+	if crc32.Checksum(raw[4:], castagnoli) != binary.BigEndian.Uint32(raw) {
+		return nil, ChecksumErr
+	}
+
+	enc := raw[blockHeaderLength:]
+	if encrypted && raw[4]&encryptedFlag == 0 {
+		return nil, DecryptErr
+	}
+
+	if raw[4]&encryptedFlag != 0 {
+		if aead == nil {
+			return nil, LockedArchiveErr
+		}
+
+		var err error
+		if enc, err = open(aead, enc, ad); err != nil {
+			return nil, err
+		}
+	}
+
+	c, err := GetCodec(CodecId(raw[4] &^ encryptedFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Decode(enc)
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Encode(src []byte) ([]byte, error) {
+	return src, nil
+}
+
+func (noneCodec) Decode(src []byte) ([]byte, error) {
+	return append([]byte(nil), src...), nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Encode(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src)
+}
+
+func (snappyCodec) Decode(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
+
+type deflateCodec struct{}
+
+func (deflateCodec) Encode(src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	w, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (deflateCodec) Decode(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Encode(src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func newZstdCodec() *zstdCodec {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		panic(err)
+	}
+
+	return &zstdCodec{enc: enc, dec: dec}
+}
+
+func (c *zstdCodec) Encode(src []byte) ([]byte, error) {
+	return c.enc.EncodeAll(src, nil), nil
+}
+
+func (c *zstdCodec) Decode(src []byte) ([]byte, error) {
+	return c.dec.DecodeAll(src, nil)
+}
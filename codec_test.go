@@ -0,0 +1,83 @@
+package raa
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *FSSuite) TestCodecs_EncodeDecode(c *C) {
+	block := bytes.Repeat([]byte("foo"), 1024)
+	for _, id := range []CodecId{NoneCodec, SnappyCodec, DeflateCodec, GzipCodec, ZstdCodec} {
+		enc, err := encodeBlock(block, id, nil, nil)
+		c.Assert(err, IsNil)
+		c.Assert(CodecId(enc[4]), Equals, id)
+
+		dec, err := decodeBlock(enc, false, nil, nil)
+		c.Assert(err, IsNil)
+		c.Assert(dec, DeepEquals, block)
+	}
+}
+
+func (s *FSSuite) TestCodecs_Unknown(c *C) {
+	_, err := encodeBlock([]byte("foo"), CodecId(42), nil, nil)
+	c.Assert(err, Equals, UnknownCodecErr)
+
+	raw := []byte{0, 0, 0, 0, 42, 'f', 'o', 'o'}
+	binary.BigEndian.PutUint32(raw, crc32.Checksum(raw[4:], castagnoli))
+	_, err = decodeBlock(raw, false, nil, nil)
+	c.Assert(err, Equals, UnknownCodecErr)
+
+	_, err = decodeBlock(nil, false, nil, nil)
+	c.Assert(err, Equals, EmptyBlockErr)
+}
+
+func (s *FSSuite) TestDecodeBlock_Corrupted(c *C) {
+	enc, err := encodeBlock([]byte("foo"), NoneCodec, nil, nil)
+	c.Assert(err, IsNil)
+
+	enc[len(enc)-1] = 'x'
+	_, err = decodeBlock(enc, false, nil, nil)
+	c.Assert(err, Equals, ChecksumErr)
+}
+
+type reverseCodec struct{}
+
+func (reverseCodec) Encode(src []byte) ([]byte, error) {
+	dst := make([]byte, len(src))
+	for i, b := range src {
+		dst[len(src)-1-i] = b
+	}
+
+	return dst, nil
+}
+
+func (r reverseCodec) Decode(src []byte) ([]byte, error) {
+	return r.Encode(src)
+}
+
+func (s *FSSuite) TestRegisterCodec(c *C) {
+	RegisterCodec(CodecId(42), reverseCodec{})
+	defer delete(codecs, CodecId(42))
+
+	enc, err := encodeBlock([]byte("foo"), CodecId(42), nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(string(enc[blockHeaderLength:]), Equals, "oof")
+
+	dec, err := decodeBlock(enc, false, nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(string(dec), Equals, "foo")
+}
+
+func (s *FSSuite) TestParseCodec(c *C) {
+	id, err := ParseCodec("zstd")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, ZstdCodec)
+	c.Assert(id.String(), Equals, "zstd")
+
+	_, err = ParseCodec("foo")
+	c.Assert(err, Equals, UnknownCodecErr)
+	c.Assert(CodecId(42).String(), Equals, "codec(42)")
+}
@@ -0,0 +1,305 @@
+package raa
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/mcuadros/bolt"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+const KeyLength = 32
+
+var (
+	LockedArchiveErr = errors.New("encrypted archive, a key or passphrase is required")
+	WrongKeyErr      = errors.New("wrong key or passphrase")
+	InvalidKeyErr    = errors.New("invalid key, must be 32 bytes long")
+	DecryptErr       = errors.New("unable to decrypt the block, authentication failed")
+	InvalidKdfErr    = errors.New("invalid key derivation parameters")
+	PlaintextErr     = errors.New("cannot encrypt an archive holding unencrypted blocks")
+
+	kdfKey      = []byte("kdf")
+	keyCheckKey = []byte("key_check")
+)
+
+// Parameters of scrypt, used to derive the keys from the passphrases of the
+// new encrypted archives
+var (
+	ScryptN = 32768
+	ScryptR = 8
+	ScryptP = 1
+)
+
+const (
+	rawKdf byte = iota
+	scryptKdf
+)
+
+const (
+	saltLength      = 16
+	kdfParamsLength = 13 + saltLength
+)
+
+// labels of the subkeys derived from the key of an archive, the blocks are
+// encrypted with one and the ids of the deduplicated blocks keyed with the
+// other, so the same key is never used by two primitives
+const (
+	encKeyLabel   = "raa-enc"
+	dedupKeyLabel = "raa-dedup"
+)
+
+// kdfParams are the parameters used to derive the key of an archive, are
+// stored at the archive metadata with the following format:
+// - 1-byte kdf, 0 for raw keys and 1 for scrypt
+// - 4-byte N, 4-byte r and 4-byte p parameters of scrypt, BigEndian
+// - 16-byte salt
+type kdfParams struct {
+	kdf     byte
+	n, r, p int
+	salt    []byte
+}
+
+func newScryptParams() (*kdfParams, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return &kdfParams{kdf: scryptKdf, n: ScryptN, r: ScryptR, p: ScryptP, salt: salt}, nil
+}
+
+func parseKdfParams(v []byte) (*kdfParams, error) {
+	if len(v) != kdfParamsLength || v[0] > scryptKdf {
+		return nil, InvalidKdfErr
+	}
+
+	return &kdfParams{
+		kdf:  v[0],
+		n:    int(binary.BigEndian.Uint32(v[1:])),
+		r:    int(binary.BigEndian.Uint32(v[5:])),
+		p:    int(binary.BigEndian.Uint32(v[9:])),
+		salt: append([]byte(nil), v[13:]...),
+	}, nil
+}
+
+func (p *kdfParams) bytes() []byte {
+	v := make([]byte, kdfParamsLength)
+	v[0] = p.kdf
+	binary.BigEndian.PutUint32(v[1:], uint32(p.n))
+	binary.BigEndian.PutUint32(v[5:], uint32(p.r))
+	binary.BigEndian.PutUint32(v[9:], uint32(p.p))
+	copy(v[13:], p.salt)
+
+	return v
+}
+
+func (p *kdfParams) deriveKey(passphrase []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, p.salt, p.n, p.r, p.p, KeyLength)
+}
+
+// Encrypted returns true if the blocks of the archive are encrypted
+func (a *Archive) Encrypted() bool {
+	return a.kdf != nil
+}
+
+// SetPassphrase enables the encryption of the blocks using AES-256-GCM with a
+// key derived from the passphrase, the salt and the parameters of the key
+// derivation are stored in the archive. If the archive is already encrypted
+// the passphrase is verified and used to unlock the archive. An unencrypted
+// archive already holding blocks can not be encrypted.
+func (a *Archive) SetPassphrase(passphrase []byte) error {
+	if a.kdf != nil {
+		if a.kdf.kdf != scryptKdf {
+			return WrongKeyErr
+		}
+
+		key, err := a.kdf.deriveKey(passphrase)
+		if err != nil {
+			return err
+		}
+
+		return a.unlock(key)
+	}
+
+	p, err := newScryptParams()
+	if err != nil {
+		return err
+	}
+
+	key, err := p.deriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+
+	return a.enableEncryption(p, key)
+}
+
+// SetKey is like SetPassphrase but using a raw 32-byte key
+func (a *Archive) SetKey(key []byte) error {
+	if len(key) != KeyLength {
+		return InvalidKeyErr
+	}
+
+	if a.kdf != nil {
+		if a.kdf.kdf != rawKdf {
+			return WrongKeyErr
+		}
+
+		return a.unlock(key)
+	}
+
+	return a.enableEncryption(&kdfParams{kdf: rawKdf, salt: make([]byte, saltLength)}, key)
+}
+
+// enableEncryption stores the kdf params and a sealed known value, used to
+// verify the key when the archive is unlocked, the archive must not hold
+// any block yet
+func (a *Archive) enableEncryption(p *kdfParams, key []byte) error {
+	aead, dedupKey, err := newCiphers(key)
+	if err != nil {
+		return err
+	}
+
+	check, err := seal(aead, keyCheckKey, keyCheckKey)
+	if err != nil {
+		return err
+	}
+
+	err = a.update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(blocksBucket); b != nil {
+			if k, _ := b.Cursor().First(); k != nil {
+				return PlaintextErr
+			}
+		}
+
+		b, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		if err := b.Put(kdfKey, p.bytes()); err != nil {
+			return err
+		}
+
+		return b.Put(keyCheckKey, check)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	a.kdf, a.aead, a.dedupKey = p, aead, dedupKey
+	return nil
+}
+
+func (a *Archive) unlock(key []byte) error {
+	aead, dedupKey, err := newCiphers(key)
+	if err != nil {
+		return err
+	}
+
+	var check []byte
+	a.view(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(metaBucket); b != nil {
+			check = append(check, b.Get(keyCheckKey)...)
+		}
+
+		return nil
+	})
+
+	if _, err := open(aead, check, keyCheckKey); err != nil {
+		return WrongKeyErr
+	}
+
+	a.aead, a.dedupKey = aead, dedupKey
+	return nil
+}
+
+// newCiphers derives the subkeys from the key of the archive, and returns the
+// AEAD encrypting the blocks and the key of the deduplicated block ids
+func newCiphers(key []byte) (cipher.AEAD, []byte, error) {
+	encKey, err := subkey(key, encKeyLabel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dedupKey, err := subkey(key, dedupKeyLabel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newAEAD(encKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return aead, dedupKey, nil
+}
+
+// subkey derives with HKDF-SHA256 the subkey with the given label
+func subkey(key []byte, label string) ([]byte, error) {
+	k := make([]byte, KeyLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(label)), k); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts and authenticates plaintext and authenticates ad, a random
+// nonce is generated and prepended to the result
+func seal(aead cipher.AEAD, plaintext, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+// open decrypts a value encrypted by seal
+func open(aead cipher.AEAD, sealed, ad []byte) ([]byte, error) {
+	size := aead.NonceSize()
+	if len(sealed) < size {
+		return nil, DecryptErr
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:size], sealed[size:], ad)
+	if err != nil {
+		return nil, DecryptErr
+	}
+
+	return plaintext, nil
+}
+
+// blockAD returns the additional data authenticated with a block, the id of
+// the block, the inode of the file and his index inside of it. Deduplicated
+// blocks can be shared by different files and positions, their id is already
+// bound to the content.
+func blockAD(id []byte, inode uint64, n int) []byte {
+	if isSharedBlock(id) {
+		return id
+	}
+
+	ad := make([]byte, len(id)+16)
+	copy(ad, id)
+	binary.BigEndian.PutUint64(ad[len(id):], inode)
+	binary.BigEndian.PutUint64(ad[len(id)+8:], uint64(n))
+
+	return ad
+}
@@ -0,0 +1,189 @@
+package raa
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"os"
+
+	"github.com/mcuadros/bolt"
+	. "gopkg.in/check.v1"
+)
+
+var testKey = bytes.Repeat([]byte{42}, KeyLength)
+
+func (s *FSSuite) TestArchive_SetKey(c *C) {
+	c.Assert(s.a.Encrypted(), Equals, false)
+	c.Assert(s.a.SetKey([]byte("foo")), Equals, InvalidKeyErr)
+	c.Assert(s.a.SetKey(testKey), IsNil)
+	c.Assert(s.a.Encrypted(), Equals, true)
+
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 3
+	f.WriteString("foobarqux")
+	c.Assert(f.Close(), IsNil)
+
+	s.a.db.View(func(tx *bolt.Tx) error {
+		tx.Bucket(blocksBucket).ForEach(func(k, v []byte) error {
+			c.Assert(v[4]&encryptedFlag, Not(Equals), 0)
+			c.Assert(bytes.Contains(v, []byte("foo")), Equals, false)
+			return nil
+		})
+
+		return nil
+	})
+
+	s.reopen(c)
+	c.Assert(s.a.Encrypted(), Equals, true)
+
+	f, _ = s.a.Open("foo")
+	_, err := f.Read(make([]byte, 3))
+	c.Assert(err.(*os.PathError).Err, Equals, LockedArchiveErr)
+
+	f, _ = s.a.Create("bar")
+	f.WriteString("bar")
+	c.Assert(f.Close(), Equals, LockedArchiveErr)
+
+	wrong := bytes.Repeat([]byte{84}, KeyLength)
+	c.Assert(s.a.SetKey(wrong), Equals, WrongKeyErr)
+	c.Assert(s.a.SetPassphrase([]byte("foo")), Equals, WrongKeyErr)
+	c.Assert(s.a.SetKey(testKey), IsNil)
+
+	f, _ = s.a.Open("foo")
+	c.Assert(f.String(), Equals, "foobarqux")
+}
+
+func (s *FSSuite) TestArchive_SetPassphrase(c *C) {
+	defer func(n int) { ScryptN = n }(ScryptN)
+	ScryptN = 1024
+
+	c.Assert(s.a.SetPassphrase([]byte("foo")), IsNil)
+
+	f, _ := s.a.Create("foo")
+	f.WriteString("foo")
+	c.Assert(f.Close(), IsNil)
+
+	s.reopen(c)
+	c.Assert(s.a.kdf.n, Equals, 1024)
+	c.Assert(s.a.SetKey(testKey), Equals, WrongKeyErr)
+	c.Assert(s.a.SetPassphrase([]byte("bar")), Equals, WrongKeyErr)
+	c.Assert(s.a.SetPassphrase([]byte("foo")), IsNil)
+
+	f, _ = s.a.Open("foo")
+	c.Assert(f.String(), Equals, "foo")
+}
+
+func (s *FSSuite) TestArchive_EncryptionBindsBlockIndex(c *C) {
+	c.Assert(s.a.SetKey(testKey), IsNil)
+
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 3
+	f.WriteString("foobar")
+	c.Assert(f.Close(), IsNil)
+
+	s.a.db.Update(func(tx *bolt.Tx) error {
+		b := getFile(tx, []byte("/foo")).Bucket(indexBucket)
+		first := append([]byte(nil), b.Get(blockKey(0))...)
+		second := append([]byte(nil), b.Get(blockKey(1))...)
+		b.Put(blockKey(0), second)
+
+		return b.Put(blockKey(1), first)
+	})
+
+	f, _ = s.a.Open("foo")
+	_, err := f.Read(make([]byte, 3))
+	c.Assert(err.(*os.PathError).Err, Equals, DecryptErr)
+}
+
+func (s *FSSuite) TestArchive_EncryptionBindsInode(c *C) {
+	c.Assert(s.a.SetKey(testKey), IsNil)
+
+	for _, name := range []string{"foo", "bar"} {
+		f, _ := s.a.Create(name)
+		f.WriteString(name)
+		c.Assert(f.Close(), IsNil)
+	}
+
+	s.a.db.Update(func(tx *bolt.Tx) error {
+		foo := getFile(tx, []byte("/foo")).Bucket(indexBucket)
+		bar := getFile(tx, []byte("/bar")).Bucket(indexBucket)
+		return foo.Put(blockKey(0), append([]byte(nil), bar.Get(blockKey(0))...))
+	})
+
+	f, _ := s.a.Open("foo")
+	_, err := f.Read(make([]byte, 3))
+	c.Assert(err.(*os.PathError).Err, Equals, DecryptErr)
+}
+
+func (s *FSSuite) TestArchive_EncryptionRebindsStagedBlocks(c *C) {
+	c.Assert(s.a.SetKey(testKey), IsNil)
+
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 3
+	f.WriteString("foobar")
+	c.Assert(f.staged, HasLen, 2)
+
+	g, _ := s.a.Create("foo")
+	g.WriteString("qux")
+	c.Assert(g.Close(), IsNil)
+
+	c.Assert(f.Close(), IsNil)
+
+	f, _ = s.a.Open("foo")
+	c.Assert(f.String(), Equals, "foobar")
+}
+
+func (s *FSSuite) TestArchive_EncryptionRejectsPlaintext(c *C) {
+	f, _ := s.a.Create("foo")
+	f.WriteString("foo")
+	c.Assert(f.Close(), IsNil)
+
+	c.Assert(s.a.SetKey(testKey), Equals, PlaintextErr)
+	c.Assert(s.a.SetPassphrase([]byte("foo")), Equals, PlaintextErr)
+	c.Assert(s.a.Encrypted(), Equals, false)
+
+	s.a.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(kdfKey, (&kdfParams{salt: make([]byte, saltLength)}).bytes())
+	})
+
+	s.reopen(c)
+	c.Assert(s.a.Encrypted(), Equals, true)
+
+	f, _ = s.a.Open("foo")
+	_, err := f.Read(make([]byte, 3))
+	c.Assert(err.(*os.PathError).Err, Equals, DecryptErr)
+}
+
+func (s *FSSuite) TestArchive_EncryptionWithDedup(c *C) {
+	c.Assert(s.a.SetKey(testKey), IsNil)
+	c.Assert(s.a.SetDedup(true), IsNil)
+
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 3
+	f.WriteString("foofoo")
+	c.Assert(f.Close(), IsNil)
+
+	stats, _ := s.a.BlockStats()
+	c.Assert(stats.Stored, Equals, int64(1))
+
+	sum := sha256.Sum256([]byte("foo"))
+	mac := hmac.New(sha256.New, testKey)
+	mac.Write([]byte("foo"))
+
+	s.a.db.View(func(tx *bolt.Tx) error {
+		c.Assert(tx.Bucket(blocksBucket).Get(sum[:]), IsNil)
+		c.Assert(tx.Bucket(blocksBucket).Get(mac.Sum(nil)), IsNil)
+		return nil
+	})
+
+	f, _ = s.a.Open("foo")
+	c.Assert(f.String(), Equals, "foofoo")
+}
+
+func (s *FSSuite) reopen(c *C) {
+	c.Assert(s.a.Close(), IsNil)
+
+	var err error
+	s.a, err = OpenArchive(s.file)
+	c.Assert(err, IsNil)
+}
@@ -1,7 +1,6 @@
 package raa
 
 import (
-	"bytes"
 	"errors"
 	"io"
 	"os"
@@ -10,44 +9,90 @@ import (
 
 const DefaultBlockSize int32 = 10485760
 
+// MaxSymlinks is the maximum number of symbolic links followed resolving a path
+const MaxSymlinks = 40
+
 var (
-	NotDirectoryErr = errors.New("not a directory")
-	ClosedFileErr   = errors.New("cannot read/write on a closed file")
-	NonReadableErr  = errors.New("cannot read from a O_WRONLY file")
-	NonWritableErr  = errors.New("cannot write from on a not O_WRONLY or O_RDWR file")
+	NotDirectoryErr     = errors.New("not a directory")
+	IsDirectoryErr      = errors.New("is a directory")
+	NotEmptyErr         = errors.New("directory not empty")
+	NotSymlinkErr       = errors.New("not a symbolic link")
+	SymlinkLoopErr      = errors.New("too many levels of symbolic links")
+	ClosedFileErr       = errors.New("cannot read/write on a closed file")
+	NonReadableErr      = errors.New("cannot read from a O_WRONLY file")
+	NonWritableErr      = errors.New("cannot write from on a not O_WRONLY or O_RDWR file")
+	InvalidOffsetErr    = errors.New("invalid offset")
+	AppendOnlyErr       = errors.New("invalid use of WriteAt on file opened with O_APPEND")
+	InvalidBlockSizeErr = errors.New("invalid block size")
+	NonEmptyFileErr     = errors.New("cannot change the block size of a non-empty file")
 )
 
 type File struct {
-	name  string
-	inode Inode
-	flag  int
-	buf   *bytes.Buffer
-	a     *Archive
+	name   string
+	inode  Inode
+	flag   int
+	a      *Archive
+	offset int64
+	dedup  bool
+
+	// newId is the inode id reserved by a new file when his first block is
+	// staged, the staged blocks are bound to it
+	newId uint64
+
+	// block holds the last decoded block, blockIndex is its position
+	block      []byte
+	blockIndex int
+	// dirty holds the decoded blocks modified since the last Sync, once a
+	// block is completely written is staged and his id kept at staged
+	dirty  map[int][]byte
+	staged map[int][]byte
+	// entries holds the directory entries pending to be returned by Readdir
+	entries []os.FileInfo
+	// xattrs holds the extended attributes changed since the last Sync, the
+	// removed ones with a nil value
+	xattrs map[string][]byte
 
 	isClosed   bool
 	isWritable bool
 	isReadable bool
 	isSync     bool
+	isAppend   bool
+	isDirty    bool
 }
 
 func newFile(a *Archive, name string, flag int, mode os.FileMode) *File {
+	codec, blockSize, dedup := DefaultCodec, DefaultBlockSize, false
+	if a != nil {
+		codec, blockSize, dedup = a.codec, a.blockSize, a.dedup
+	}
+
+	now := time.Now()
 	return &File{
 		name: name,
 		inode: Inode{
-			BlockSize:    DefaultBlockSize,
+			BlockSize:    blockSize,
 			Mode:         mode,
+			Codec:        codec,
 			UserId:       uint64(os.Getuid()),
 			GroupId:      uint64(os.Getgid()),
-			ModifcatedAt: time.Now(),
-			CreatedAt:    time.Now(),
+			ModifcatedAt: now,
+			CreatedAt:    now,
+			Links:        1,
+			AccessedAt:   now,
+			ChangedAt:    now,
 		},
-		flag: flag,
-		buf:  bytes.NewBuffer(nil),
-		a:    a,
+		flag:       flag,
+		a:          a,
+		dedup:      dedup,
+		blockIndex: -1,
+		dirty:      make(map[int][]byte, 0),
+		staged:     make(map[int][]byte, 0),
+		xattrs:     make(map[string][]byte, 0),
 
 		isReadable: isReadable(flag),
 		isWritable: isWritable(flag),
 		isSync:     isSync(flag),
+		isAppend:   isAppend(flag),
 	}
 }
 
@@ -55,16 +100,18 @@ func newFile(a *Archive, name string, flag int, mode os.FileMode) *File {
 // which must be a directory.
 // If there is an error, it will be of type *PathError.
 func (f *File) Chdir() error {
-	if true {
+	if !f.inode.Mode.IsDir() {
 		return &os.PathError{"chdir", f.name, NotDirectoryErr}
 	}
 
 	return f.a.Chdir(f.name)
 }
 
-// Chmod changes the mode of the file to mode.
+// Chmod changes the mode of the file to mode, the file type is preserved.
 func (f *File) Chmod(mode os.FileMode) error {
-	f.inode.Mode = mode
+	f.inode.Mode = f.inode.Mode&os.ModeType | mode&^os.ModeType
+	f.inode.ChangedAt = time.Now()
+	f.isDirty = true
 
 	return nil
 }
@@ -73,6 +120,49 @@ func (f *File) Chmod(mode os.FileMode) error {
 func (f *File) Chown(uid, gid int) error {
 	f.inode.UserId = uint64(uid)
 	f.inode.GroupId = uint64(gid)
+	f.inode.ChangedAt = time.Now()
+	f.isDirty = true
+
+	return nil
+}
+
+// Chtimes changes the access and modification times of the file, the change
+// time is set to the current time. The access time is not updated by reads.
+func (f *File) Chtimes(atime time.Time, mtime time.Time) error {
+	f.inode.AccessedAt = atime
+	f.inode.ModifcatedAt = mtime
+	f.inode.ChangedAt = time.Now()
+	f.isDirty = true
+
+	return nil
+}
+
+// SetCodec changes the codec used to compress the blocks written from now on,
+// the codec is recorded at the inode. By default the codec of the archive is
+// used.
+func (f *File) SetCodec(id CodecId) error {
+	if _, err := GetCodec(id); err != nil {
+		return &os.PathError{"setcodec", f.name, err}
+	}
+
+	f.inode.Codec = id
+	f.isDirty = true
+	return nil
+}
+
+// SetBlockSize changes the block size of the file, only can be called before
+// the first write, by default the block size of the archive is used.
+func (f *File) SetBlockSize(size int32) error {
+	if size <= 0 {
+		return &os.PathError{"setblocksize", f.name, InvalidBlockSizeErr}
+	}
+
+	if f.inode.Size != 0 || len(f.dirty) != 0 || len(f.staged) != 0 {
+		return &os.PathError{"setblocksize", f.name, NonEmptyFileErr}
+	}
+
+	f.inode.BlockSize = size
+	f.isDirty = true
 
 	return nil
 }
@@ -101,7 +191,12 @@ func (f *File) Read(b []byte) (int, error) {
 		return 0, &os.PathError{"read", f.name, NonReadableErr}
 	}
 
-	n, err := f.buf.Read(b)
+	if f.inode.Mode.IsDir() {
+		return 0, &os.PathError{"read", f.name, IsDirectoryErr}
+	}
+
+	n, err := f.readAt(b, f.offset)
+	f.offset += int64(n)
 	if err == io.EOF || err == nil {
 		return n, err
 	}
@@ -109,45 +204,322 @@ func (f *File) Read(b []byte) (int, error) {
 	return n, &os.PathError{"read", f.name, err}
 }
 
-//func (f *File) ReadAt(b []byte, off int64) (n int, err error)
-//func (f *File) Readdir(n int) (fi []FileInfo, err error)
-//func (f *File) Readdirnames(n int) (names []string, err error)
-//func (f *File) Seek(offset int64, whence int) (ret int64, err error)
+// readAt reads from the blocks covering the requested offset, only those
+// blocks are fetched and decoded.
+func (f *File) readAt(b []byte, off int64) (int, error) {
+	if off >= f.inode.Size {
+		return 0, io.EOF
+	}
+
+	blockSize := int64(f.inode.BlockSize)
+
+	var n int
+	for n < len(b) && off < f.inode.Size {
+		block, err := f.getBlock(int(off / blockSize))
+		if err != nil {
+			return n, err
+		}
+
+		pos := off % blockSize
+		if pos >= int64(len(block)) {
+			return n, io.ErrUnexpectedEOF
+		}
+
+		data := block[pos:]
+		if left := f.inode.Size - off; int64(len(data)) > left {
+			data = data[:left]
+		}
+
+		copied := copy(b[n:], data)
+		n += copied
+		off += int64(copied)
+	}
+
+	return n, nil
+}
+
+// getBlock returns the decoded content of the block n, the last block read is
+// cached so sequential reads only hit the archive once per block.
+func (f *File) getBlock(n int) ([]byte, error) {
+	if block, ok := f.dirty[n]; ok {
+		return block, nil
+	}
+
+	if f.block != nil && f.blockIndex == n {
+		return f.block, nil
+	}
+
+	var block []byte
+	var err error
+	if id, ok := f.staged[n]; ok {
+		block, err = f.a.readStagedBlock(id, f.blockInode(), n)
+	} else {
+		block, err = f.a.readBlock(f.inode.Id, n)
+	}
+
+	if err == ChecksumErr {
+		return nil, &CorruptBlockError{Name: f.name, Block: n}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	f.block = block
+	f.blockIndex = n
+
+	return block, nil
+}
+
+// ReadAt reads len(b) bytes from the File starting at byte offset off.
+// It returns the number of bytes read and the error, if any.
+// ReadAt always returns a non-nil error when n < len(b).
+// At end of file, that error is io.EOF.
+func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	if f.isClosed {
+		return 0, &os.PathError{"read", f.name, ClosedFileErr}
+	}
+
+	if !f.isReadable {
+		return 0, &os.PathError{"read", f.name, NonReadableErr}
+	}
+
+	if f.inode.Mode.IsDir() {
+		return 0, &os.PathError{"read", f.name, IsDirectoryErr}
+	}
+
+	if off < 0 {
+		return 0, &os.PathError{"readat", f.name, InvalidOffsetErr}
+	}
+
+	var n int
+	for n < len(b) {
+		m, err := f.readAt(b[n:], off+int64(n))
+		n += m
+
+		if err == io.EOF {
+			return n, err
+		}
+
+		if err != nil {
+			return n, &os.PathError{"read", f.name, err}
+		}
+	}
+
+	return n, nil
+}
+
+// Readdir reads the contents of the directory associated with file and
+// returns a slice of up to n FileInfo values, in directory order. Subsequent
+// calls on the same file will yield further FileInfos.
+//
+// If n > 0, Readdir returns at most n FileInfo structures. In this case, if
+// Readdir returns an empty slice, it will return a non-nil error explaining
+// why. At the end of a directory, the error is io.EOF.
+//
+// If n <= 0, Readdir returns all the FileInfo from the directory in a single
+// slice, and a nil error.
+func (f *File) Readdir(n int) ([]os.FileInfo, error) {
+	if f.isClosed {
+		return nil, &os.PathError{"readdir", f.name, ClosedFileErr}
+	}
+
+	if !f.inode.Mode.IsDir() {
+		return nil, &os.PathError{"readdir", f.name, NotDirectoryErr}
+	}
+
+	if f.entries == nil {
+		entries, err := f.a.readDir(f.name)
+		if err != nil {
+			return nil, &os.PathError{"readdir", f.name, err}
+		}
+
+		f.entries = entries
+	}
+
+	count := len(f.entries)
+	if n > 0 && n < count {
+		count = n
+	}
+
+	r := f.entries[:count]
+	f.entries = f.entries[count:]
+
+	if n > 0 && count == 0 {
+		return r, io.EOF
+	}
+
+	return r, nil
+}
+
+// Readdirnames reads and returns a slice of names from the directory f,
+// following the same rules than Readdir.
+func (f *File) Readdirnames(n int) ([]string, error) {
+	fi, err := f.Readdir(n)
+	names := make([]string, len(fi))
+	for i, entry := range fi {
+		names[i] = entry.Name()
+	}
+
+	return names, err
+}
+
+// Seek sets the offset for the next Read or Write on file to offset,
+// interpreted according to whence: 0 means relative to the origin of the file,
+// 1 means relative to the current offset, and 2 means relative to the end.
+// It returns the new offset and an error, if any.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if f.isClosed {
+		return 0, &os.PathError{"seek", f.name, ClosedFileErr}
+	}
+
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		offset += f.offset
+	case os.SEEK_END:
+		offset += f.inode.Size
+	default:
+		return 0, &os.PathError{"seek", f.name, os.ErrInvalid}
+	}
+
+	if offset < 0 {
+		return 0, &os.PathError{"seek", f.name, InvalidOffsetErr}
+	}
+
+	f.offset = offset
+	return offset, nil
+}
 
 // Stat returns a FileInfo describing the named file.
 func (f *File) Stat() (os.FileInfo, error) {
 	return &FileInfo{f.name, f.inode}, nil
 }
 
-// Sync commits the current contents of the file to stable storage.
+// Sync commits the current contents of the file to stable storage, the new
+// contents are visible to other readers atomically.
 func (f *File) Sync() error {
-	return f.a.writeFile(f)
+	if !f.isDirty {
+		return nil
+	}
+
+	if err := f.a.writeFile(f); err != nil {
+		return err
+	}
+
+	f.dirty = make(map[int][]byte, 0)
+	f.staged = make(map[int][]byte, 0)
+	f.xattrs = make(map[string][]byte, 0)
+	f.isDirty = false
+	return nil
 }
 
 // Truncate changes the size of the file.
 func (f *File) Truncate(size int64) error {
-	f.buf.Truncate(int(size))
+	if !f.isWritable {
+		return &os.PathError{"truncate", f.name, NonWritableErr}
+	}
+
+	if size < 0 {
+		return &os.PathError{"truncate", f.name, InvalidOffsetErr}
+	}
+
+	if err := f.truncate(size); err != nil {
+		return &os.PathError{"truncate", f.name, err}
+	}
+
+	f.modified()
+	return nil
+}
+
+func (f *File) truncate(size int64) error {
+	if size >= f.inode.Size {
+		return f.fill(size)
+	}
+
+	f.uncacheBlock(-1)
+
+	blockSize := int64(f.inode.BlockSize)
+	for n := range f.dirty {
+		if int64(n)*blockSize >= size {
+			delete(f.dirty, n)
+		}
+	}
+
+	var released [][]byte
+	for n, id := range f.staged {
+		if int64(n)*blockSize >= size {
+			released = append(released, id)
+			delete(f.staged, n)
+		}
+	}
+
+	if err := f.a.releaseBlocks(released...); err != nil {
+		return err
+	}
+
+	if pos := size % blockSize; pos != 0 {
+		n := int(size / blockSize)
+		block, err := f.getWritableBlock(n)
+		if err != nil {
+			return err
+		}
 
+		f.dirty[n] = block[:pos]
+	}
+
+	f.inode.Size = size
 	return nil
 }
 
 // Write writes len(b) bytes to the File.
 // It returns the number of bytes written and an error, if any.
 // Write returns a non-nil error when n != len(b).
+// If the file was opened with O_APPEND, the data is always written at the
+// end of the file.
 func (f *File) Write(b []byte) (int, error) {
+	off := f.offset
+	if f.isAppend {
+		off = f.inode.Size
+	}
+
+	n, err := f.write(b, off)
+	f.offset = off + int64(n)
+
+	return n, err
+}
+
+// WriteAt writes len(b) bytes to the File starting at byte offset off.
+// It returns the number of bytes written and an error, if any.
+// WriteAt returns a non-nil error when n != len(b).
+func (f *File) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &os.PathError{"writeat", f.name, InvalidOffsetErr}
+	}
+
+	if f.isAppend {
+		return 0, &os.PathError{"writeat", f.name, AppendOnlyErr}
+	}
+
+	return f.write(b, off)
+}
+
+func (f *File) write(b []byte, off int64) (int, error) {
 	if f.isClosed {
-		return 0, &os.PathError{"read", f.name, ClosedFileErr}
+		return 0, &os.PathError{"write", f.name, ClosedFileErr}
 	}
 
 	if !f.isWritable {
-		return 0, &os.PathError{"read", f.name, NonWritableErr}
+		return 0, &os.PathError{"write", f.name, NonWritableErr}
 	}
 
-	n, err := f.buf.Write(b)
-	f.inode.Size += int64(n)
+	n, err := f.writeAt(b, off)
+	if n > 0 {
+		f.modified()
+	}
 
 	if err != nil {
-		err = &os.PathError{"write", f.name, err}
+		return n, &os.PathError{"write", f.name, err}
 	}
 
 	if n != len(b) {
@@ -160,10 +532,136 @@ func (f *File) Write(b []byte) (int, error) {
 		}
 	}
 
-	return n, err
+	return n, nil
+}
+
+// writeAt patches the blocks covering the given range, any gap between the
+// current end of file and off is filled with zeros
+func (f *File) writeAt(b []byte, off int64) (int, error) {
+	if err := f.fill(off); err != nil {
+		return 0, err
+	}
+
+	blockSize := int64(f.inode.BlockSize)
+
+	var n int
+	for n < len(b) {
+		i := int(off / blockSize)
+		block, err := f.getWritableBlock(i)
+		if err != nil {
+			return n, err
+		}
+
+		pos := int(off % blockSize)
+		end := pos + len(b) - n
+		if end > int(blockSize) {
+			end = int(blockSize)
+		}
+
+		if end > len(block) {
+			block = append(block, make([]byte, end-len(block))...)
+		}
+
+		copied := copy(block[pos:end], b[n:])
+		f.dirty[i] = block
+
+		n += copied
+		off += int64(copied)
+		if off > f.inode.Size {
+			f.inode.Size = off
+		}
+
+		if end == int(blockSize) {
+			if err := f.stageBlock(i); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// modified updates the modification and change times of the file
+func (f *File) modified() {
+	now := time.Now()
+	f.inode.ModifcatedAt = now
+	f.inode.ChangedAt = now
+	f.isDirty = true
+}
+
+// blockInode returns the inode id the blocks of the file are bound to
+func (f *File) blockInode() uint64 {
+	if f.inode.Id == 0 {
+		return f.newId
+	}
+
+	return f.inode.Id
+}
+
+// stageBlock compresses and stores a block as soon as is completely written,
+// releasing the memory used by it. The block is not visible until Sync.
+func (f *File) stageBlock(n int) error {
+	id, err := f.a.stageBlock(f, n)
+	if err != nil {
+		return err
+	}
+
+	f.staged[n] = id
+	delete(f.dirty, n)
+	f.uncacheBlock(n)
+
+	return nil
+}
+
+// fill writes zeros from the current end of file up to size
+func (f *File) fill(size int64) error {
+	if size <= f.inode.Size {
+		return nil
+	}
+
+	zeros := make([]byte, f.inode.BlockSize)
+	for f.inode.Size < size {
+		chunk := size - f.inode.Size
+		if chunk > int64(len(zeros)) {
+			chunk = int64(len(zeros))
+		}
+
+		if _, err := f.writeAt(zeros[:chunk], f.inode.Size); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-//func (f *File) WriteAt(b []byte, off int64) (n int, err error) {}
+// getWritableBlock returns the decoded block n ready to be modified, blocks
+// past the end of file are returned empty
+func (f *File) getWritableBlock(n int) ([]byte, error) {
+	if block, ok := f.dirty[n]; ok {
+		return block, nil
+	}
+
+	if int64(n)*int64(f.inode.BlockSize) >= f.inode.Size {
+		return nil, nil
+	}
+
+	block, err := f.getBlock(n)
+	if err != nil {
+		return nil, err
+	}
+
+	f.uncacheBlock(n)
+	return block, nil
+}
+
+// uncacheBlock drops the cached block if is the block n, or any block if n is
+// negative, once the block is modified the cached content is stale
+func (f *File) uncacheBlock(n int) {
+	if n < 0 || f.blockIndex == n {
+		f.block = nil
+		f.blockIndex = -1
+	}
+}
 
 // WriteString is like Write, but writes the contents of string s rather than
 // a slice of bytes.
@@ -173,12 +671,19 @@ func (f *File) WriteString(s string) (int, error) {
 
 // Bytes returns a slice of the contents of the unread portion of the file
 func (f *File) Bytes() []byte {
-	return f.buf.Bytes()
+	if f.offset >= f.inode.Size {
+		return nil
+	}
+
+	b := make([]byte, f.inode.Size-f.offset)
+	n, _ := f.readAt(b, f.offset)
+
+	return b[:n]
 }
 
 // String returns the contents of the unread portion of the files as a string
 func (f *File) String() string {
-	return f.buf.String()
+	return string(f.Bytes())
 }
 
 func isWritable(flag int) bool {
@@ -196,3 +701,7 @@ func isReadable(flag int) bool {
 func isSync(flag int) bool {
 	return flag&os.O_SYNC != 0
 }
+
+func isAppend(flag int) bool {
+	return flag&os.O_APPEND != 0
+}
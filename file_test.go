@@ -1,9 +1,15 @@
 package raa
 
 import (
+	"archive/zip"
 	"bytes"
+	"io"
+	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/mcuadros/bolt"
 	. "gopkg.in/check.v1"
 )
 
@@ -17,7 +23,7 @@ func (s *FSSuite) TestNewFile(c *C) {
 	c.Assert(f.inode.GroupId, Equals, uint64(os.Getgid()))
 	c.Assert(f.inode.CreatedAt.Unix(), Not(Equals), 0)
 	c.Assert(f.inode.CreatedAt.Unix(), Equals, f.inode.ModifcatedAt.Unix())
-	c.Assert(f.buf.Len(), Equals, 0)
+	c.Assert(f.dirty, HasLen, 0)
 
 	c.Assert(f.isReadable, Equals, false)
 	c.Assert(f.isWritable, Equals, true)
@@ -37,12 +43,113 @@ func (s *FSSuite) TestNewFile(c *C) {
 	c.Assert(f.isReadable, Equals, true)
 	c.Assert(f.isWritable, Equals, false)
 	c.Assert(f.isSync, Equals, true)
+
+	f = newFile(nil, "foo", os.O_WRONLY|os.O_APPEND, 0042)
+	c.Assert(f.isWritable, Equals, true)
+	c.Assert(f.isAppend, Equals, true)
+}
+
+func (s *FSSuite) TestFile_SetBlockSize(c *C) {
+	f, _ := s.a.Create("foo")
+	c.Assert(f.SetBlockSize(-1), FitsTypeOf, &os.PathError{})
+	c.Assert(f.SetBlockSize(2), IsNil)
+	f.WriteString("foobar")
+	c.Assert(f.SetBlockSize(4), FitsTypeOf, &os.PathError{})
+	f.Close()
+
+	f, _ = s.a.Open("foo")
+	c.Assert(f.inode.BlockSize, Equals, int32(2))
+	c.Assert(f.String(), Equals, "foobar")
+	c.Assert(countBlocks(s.a), Equals, 3)
 }
 
 func (s *FSSuite) TestFile_Chdir(c *C) {
 	f, _ := s.a.Create("foo")
 	err := f.Chdir()
 	c.Assert(err, FitsTypeOf, &os.PathError{})
+
+	s.a.Mkdir("bar", 0755)
+	f, _ = s.a.Open("bar")
+	c.Assert(f.Chdir(), IsNil)
+
+	path, _ := s.a.Getwd()
+	c.Assert(path, Equals, "/bar")
+
+	f, _ = s.a.Create("baz")
+	c.Assert(f.Name(), Equals, "/bar/baz")
+}
+
+func (s *FSSuite) TestFile_Readdir(c *C) {
+	s.a.MkdirAll("/foo/bar", 0755)
+	for _, name := range []string{"/foo/baz", "/foo/qux/qux", "/foobar"} {
+		f, _ := s.a.Create(name)
+		f.WriteString("foo")
+		f.Close()
+	}
+
+	f, err := s.a.Open("/foo")
+	c.Assert(err, IsNil)
+
+	fi, err := f.Readdir(2)
+	c.Assert(err, IsNil)
+	c.Assert(fi, HasLen, 2)
+	c.Assert(fi[0].Name(), Equals, "bar")
+	c.Assert(fi[0].IsDir(), Equals, true)
+	c.Assert(fi[1].Name(), Equals, "baz")
+	c.Assert(fi[1].Size(), Equals, int64(3))
+
+	fi, err = f.Readdir(2)
+	c.Assert(err, IsNil)
+	c.Assert(fi, HasLen, 1)
+	c.Assert(fi[0].Name(), Equals, "qux")
+	c.Assert(fi[0].IsDir(), Equals, true)
+
+	fi, err = f.Readdir(2)
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(fi, HasLen, 0)
+
+	fi, err = f.Readdir(0)
+	c.Assert(err, IsNil)
+	c.Assert(fi, HasLen, 0)
+}
+
+func (s *FSSuite) TestFile_Readdirnames(c *C) {
+	s.a.Mkdir("/foo", 0755)
+	s.a.Mkdir("/bar", 0755)
+
+	f, _ := s.a.Open("/")
+	names, err := f.Readdirnames(-1)
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"bar", "foo"})
+
+	f, _ = s.a.Open("/foo")
+	names, err = f.Readdirnames(-1)
+	c.Assert(err, IsNil)
+	c.Assert(names, HasLen, 0)
+
+	f, _ = s.a.Create("/baz")
+	_, err = f.Readdirnames(-1)
+	c.Assert(err.(*os.PathError).Err, Equals, NotDirectoryErr)
+}
+
+func (s *FSSuite) TestFile_Chtimes(c *C) {
+	f, _ := s.a.Create("foo")
+	mtime := time.Unix(42, 42)
+	f.Chtimes(mtime, mtime)
+	f.Close()
+
+	f, _ = s.a.Open("foo")
+	c.Assert(f.inode.ModifcatedAt.Equal(mtime), Equals, true)
+	c.Assert(f.inode.AccessedAt.Equal(mtime), Equals, true)
+
+	f, _ = s.a.OpenFile("foo", os.O_WRONLY, 0)
+	f.WriteString("foo")
+	f.Close()
+
+	f, _ = s.a.Open("foo")
+	c.Assert(f.inode.ModifcatedAt.After(mtime), Equals, true)
+	c.Assert(f.inode.ChangedAt.Equal(f.inode.ModifcatedAt), Equals, true)
+	c.Assert(f.inode.AccessedAt.Equal(mtime), Equals, true)
 }
 
 func (s *FSSuite) TestFile_Stat(c *C) {
@@ -84,14 +191,283 @@ func (s *FSSuite) TestFile_WriteInSynced(c *C) {
 	f.WriteString("foo")
 
 	r, _ := s.a.OpenFile("foo", os.O_RDONLY, 0)
-	c.Assert(r.buf.String(), Equals, "foo")
+	c.Assert(r.String(), Equals, "foo")
 
 	n, err := f.WriteString("bar")
 	c.Assert(err, IsNil)
 	c.Assert(n, Equals, 3)
 
 	r, _ = s.a.OpenFile("foo", os.O_RDONLY, 0)
-	c.Assert(r.buf.String(), Equals, "foobar")
+	c.Assert(r.String(), Equals, "foobar")
+}
+
+func (s *FSSuite) TestFile_WriteAt(c *C) {
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 3
+	f.WriteString("foobarqux")
+	f.Close()
+
+	f, _ = s.a.OpenFile("foo", os.O_RDWR, 0)
+	n, err := f.WriteAt([]byte("BA"), 3)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	c.Assert(f.dirty, HasLen, 1)
+	c.Assert(string(f.dirty[1]), Equals, "BAr")
+	c.Assert(f.inode.Size, Equals, int64(9))
+	c.Assert(f.Close(), IsNil)
+
+	f, _ = s.a.Open("foo")
+	c.Assert(f.String(), Equals, "fooBArqux")
+}
+
+func (s *FSSuite) TestFile_WriteAtPastEOF(c *C) {
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 3
+	f.WriteString("foo")
+	f.Close()
+
+	f, _ = s.a.OpenFile("foo", os.O_RDWR, 0)
+	n, err := f.WriteAt([]byte("bar"), 5)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	c.Assert(f.inode.Size, Equals, int64(8))
+	c.Assert(f.Close(), IsNil)
+
+	f, _ = s.a.Open("foo")
+	c.Assert(f.inode.Size, Equals, int64(8))
+	c.Assert(f.String(), Equals, "foo\x00\x00bar")
+}
+
+func (s *FSSuite) TestFile_WriteStaged(c *C) {
+	f, _ := s.a.Create("foo")
+	f.WriteString("foo")
+	f.Close()
+
+	f, _ = s.a.OpenFile("foo", os.O_WRONLY|os.O_TRUNC, 0)
+	f.inode.BlockSize = 3
+	f.WriteString("quxbarb")
+	c.Assert(f.staged, HasLen, 2)
+	c.Assert(f.dirty, HasLen, 1)
+
+	r, _ := s.a.Open("foo")
+	c.Assert(r.String(), Equals, "foo")
+
+	c.Assert(f.Close(), IsNil)
+	c.Assert(f.staged, HasLen, 0)
+	c.Assert(f.dirty, HasLen, 0)
+
+	r, _ = s.a.Open("foo")
+	c.Assert(r.String(), Equals, "quxbarb")
+	c.Assert(countBlocks(s.a), Equals, 3)
+
+	c.Assert(s.a.Remove("foo"), IsNil)
+	c.Assert(countBlocks(s.a), Equals, 0)
+}
+
+func (s *FSSuite) TestFile_WriteStagedNeverClosed(c *C) {
+	f, _ := s.a.Create("foo")
+	f.WriteString("foo")
+	c.Assert(f.Close(), IsNil)
+
+	f, _ = s.a.OpenFile("foo", os.O_WRONLY|os.O_TRUNC, 0)
+	f.inode.BlockSize = 3
+	f.WriteString("quxbarb")
+	c.Assert(f.staged, HasLen, 2)
+	c.Assert(countBlocks(s.a), Equals, 3)
+
+	c.Assert(s.a.Close(), IsNil)
+
+	var err error
+	s.a, err = OpenArchive(s.file)
+	c.Assert(err, IsNil)
+	c.Assert(countBlocks(s.a), Equals, 1)
+
+	r, _ := s.a.Open("foo")
+	c.Assert(r.String(), Equals, "foo")
+}
+
+func countBlocks(a *Archive) int {
+	var count int
+	a.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(blocksBucket).Stats().KeyN
+		return nil
+	})
+
+	return count
+}
+
+func (s *FSSuite) TestFile_WriteAppend(c *C) {
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 3
+	f.WriteString("foob")
+	f.Close()
+
+	f, err := s.a.OpenFile("foo", os.O_WRONLY|os.O_APPEND, 0)
+	c.Assert(err, IsNil)
+	c.Assert(f.inode.Size, Equals, int64(4))
+
+	f.Seek(0, os.SEEK_SET)
+	n, err := f.WriteString("ar")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	c.Assert(f.staged, HasLen, 1)
+	c.Assert(f.dirty, HasLen, 0)
+
+	n, err = f.WriteString("qux")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	c.Assert(f.staged, HasLen, 2)
+
+	_, err = f.WriteAt([]byte("foo"), 0)
+	c.Assert(err, FitsTypeOf, &os.PathError{})
+	c.Assert(f.Close(), IsNil)
+
+	f, _ = s.a.Open("foo")
+	c.Assert(f.String(), Equals, "foobarqux")
+	c.Assert(countBlocks(s.a), Equals, 3)
+}
+
+func (s *FSSuite) TestFile_WriteAtNegative(c *C) {
+	f, _ := s.a.Create("foo")
+	_, err := f.WriteAt([]byte("foo"), -1)
+	c.Assert(err, FitsTypeOf, &os.PathError{})
+}
+
+func (s *FSSuite) TestFile_Truncate(c *C) {
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 3
+	f.WriteString("foobarqux")
+	f.Close()
+
+	f, _ = s.a.OpenFile("foo", os.O_RDWR, 0)
+	c.Assert(f.Truncate(4), IsNil)
+	c.Assert(f.String(), Equals, "foob")
+
+	c.Assert(f.Truncate(6), IsNil)
+	c.Assert(f.String(), Equals, "foob\x00\x00")
+	c.Assert(f.Close(), IsNil)
+
+	f, _ = s.a.Open("foo")
+	c.Assert(f.String(), Equals, "foob\x00\x00")
+	c.Assert(f.Truncate(1), FitsTypeOf, &os.PathError{})
+}
+
+func (s *FSSuite) TestFile_TruncateAndRewrite(c *C) {
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 4
+	f.WriteString("AAAABBBB")
+	c.Assert(f.Close(), IsNil)
+
+	f, _ = s.a.OpenFile("foo", os.O_RDWR, 0)
+	b := make([]byte, 4)
+	f.Read(b)
+	c.Assert(string(b), Equals, "AAAA")
+
+	c.Assert(f.Truncate(0), IsNil)
+	_, err := f.WriteAt([]byte("CCCC"), 0)
+	c.Assert(err, IsNil)
+
+	_, err = f.ReadAt(b, 0)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "CCCC")
+	c.Assert(f.Close(), IsNil)
+}
+
+func (s *FSSuite) TestFile_TruncateReleasesBlocks(c *C) {
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 3
+	f.WriteString("foobarquxfoobar")
+	c.Assert(f.Close(), IsNil)
+
+	f, _ = s.a.OpenFile("foo", os.O_RDWR, 0)
+	c.Assert(f.Truncate(4), IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	stats, _ := s.a.BlockStats()
+	c.Assert(stats.Stored, Equals, int64(2))
+
+	f, _ = s.a.Open("foo")
+	c.Assert(f.inode.Blocks, Equals, uint64(2))
+	c.Assert(f.String(), Equals, "foob")
+
+	c.Assert(s.a.Truncate("foo", 0), IsNil)
+
+	stats, _ = s.a.BlockStats()
+	c.Assert(stats.Stored, Equals, int64(0))
+}
+
+func (s *FSSuite) TestFile_Overwrite(c *C) {
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 3
+	f.WriteString("foobarquxfoobar")
+	c.Assert(f.Close(), IsNil)
+
+	f, _ = s.a.Create("foo")
+	f.WriteString("qux")
+	c.Assert(f.Close(), IsNil)
+
+	stats, _ := s.a.BlockStats()
+	c.Assert(stats.Stored, Equals, int64(1))
+
+	s.a.db.View(func(tx *bolt.Tx) error {
+		k, _ := getFile(tx, []byte("/foo")).Bucket(indexBucket).Cursor().Last()
+		c.Assert(k, DeepEquals, blockKey(0))
+		return nil
+	})
+
+	f, _ = s.a.Open("foo")
+	c.Assert(f.String(), Equals, "qux")
+}
+
+func (s *FSSuite) TestFile_WrongBlocks(c *C) {
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 3
+	f.WriteString("foobar")
+	c.Assert(f.Close(), IsNil)
+
+	s.a.db.Update(func(tx *bolt.Tx) error {
+		file := getFile(tx, []byte("/foo"))
+		i, _ := getInode(file)
+		i.Blocks = 5
+
+		return putInode(file, i)
+	})
+
+	_, err := s.a.Open("foo")
+	c.Assert(err.(*os.PathError).Err, Equals, WrongInodeBlocks)
+
+	f, err = s.a.Create("foo")
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	_, err = s.a.Open("foo")
+	c.Assert(err, IsNil)
+}
+
+func (s *FSSuite) TestFile_WrongIndex(c *C) {
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 3
+	f.WriteString("foobarqux")
+	c.Assert(f.Close(), IsNil)
+
+	s.a.db.Update(func(tx *bolt.Tx) error {
+		return getFile(tx, []byte("/foo")).Bucket(indexBucket).Delete(blockKey(1))
+	})
+
+	f, err := s.a.Open("foo")
+	c.Assert(err, IsNil)
+
+	_, err = f.ReadAt(make([]byte, 3), 3)
+	c.Assert(err.(*os.PathError).Err, Equals, missingBlockError)
+
+	s.a.db.Update(func(tx *bolt.Tx) error {
+		index := getFile(tx, []byte("/foo")).Bucket(indexBucket)
+		index.Put(blockKey(1), index.Get(blockKey(0)))
+		return index.Put(blockKey(3), index.Get(blockKey(0)))
+	})
+
+	_, err = s.a.Open("foo")
+	c.Assert(err.(*os.PathError).Err, Equals, WrongInodeBlocks)
 }
 
 func (s *FSSuite) TestFile_WriteString(c *C) {
@@ -117,12 +493,17 @@ func (s *FSSuite) TestFile_WriteLongFile(c *C) {
 	fsFile, err = s.a.Open("foo")
 	c.Assert(err, IsNil)
 	c.Assert(fsFile.inode.Size, Equals, int64(length))
-	c.Assert(fsFile.buf.Len(), Equals, length)
+	c.Assert(fsFile.dirty, HasLen, 0)
+
+	content, err := ioutil.ReadAll(fsFile)
+	c.Assert(err, IsNil)
+	c.Assert(content, DeepEquals, bytes.Repeat([]byte("f"), length))
 }
 
 func (s *FSSuite) TestFile_Read(c *C) {
 	f, _ := s.a.Create("foo")
 	f.WriteString("foo")
+	f.Seek(0, os.SEEK_SET)
 	defer f.Close()
 
 	content := make([]byte, 3)
@@ -132,6 +513,143 @@ func (s *FSSuite) TestFile_Read(c *C) {
 	c.Assert(string(content), Equals, "foo")
 }
 
+func (s *FSSuite) TestFile_ReadByBlocks(c *C) {
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 2
+	f.WriteString("foobarqux")
+	f.Close()
+
+	f, _ = s.a.Open("foo")
+	defer f.Close()
+
+	content := make([]byte, 3)
+	n, err := f.Read(content)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	c.Assert(string(content), Equals, "foo")
+	c.Assert(f.blockIndex, Equals, 1)
+
+	n, err = f.Read(content)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	c.Assert(string(content), Equals, "bar")
+
+	n, err = f.Read(content)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	c.Assert(string(content), Equals, "qux")
+	c.Assert(f.blockIndex, Equals, 4)
+
+	_, err = f.Read(content)
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (s *FSSuite) TestFile_ReadAt(c *C) {
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 2
+	f.WriteString("foobarqux")
+	f.Close()
+
+	f, _ = s.a.Open("foo")
+	defer f.Close()
+
+	content := make([]byte, 4)
+	n, err := f.ReadAt(content, 3)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 4)
+	c.Assert(string(content), Equals, "barq")
+
+	n, err = f.ReadAt(content, 7)
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(n, Equals, 2)
+	c.Assert(string(content[:n]), Equals, "ux")
+
+	_, err = f.ReadAt(content, -1)
+	c.Assert(err, FitsTypeOf, &os.PathError{})
+
+	c.Assert(f.String(), Equals, "foobarqux")
+}
+
+func (s *FSSuite) TestFile_ReadAtZip(c *C) {
+	buf := bytes.NewBuffer(nil)
+	w := zip.NewWriter(buf)
+	zf, _ := w.Create("qux")
+	zf.Write([]byte("foo"))
+	w.Close()
+
+	f, _ := s.a.Create("foo.zip")
+	f.inode.BlockSize = 16
+	f.Write(buf.Bytes())
+	f.Close()
+
+	f, _ = s.a.Open("foo.zip")
+	defer f.Close()
+
+	r, err := zip.NewReader(f, f.inode.Size)
+	c.Assert(err, IsNil)
+	c.Assert(r.File, HasLen, 1)
+
+	rc, err := r.File[0].Open()
+	c.Assert(err, IsNil)
+
+	content, _ := ioutil.ReadAll(rc)
+	c.Assert(string(content), Equals, "foo")
+}
+
+func (s *FSSuite) TestFile_Seek(c *C) {
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 2
+	f.WriteString("foobarqux")
+	f.Close()
+
+	f, _ = s.a.Open("foo")
+	defer f.Close()
+
+	ret, err := f.Seek(3, os.SEEK_SET)
+	c.Assert(err, IsNil)
+	c.Assert(ret, Equals, int64(3))
+
+	ret, err = f.Seek(3, os.SEEK_CUR)
+	c.Assert(err, IsNil)
+	c.Assert(ret, Equals, int64(6))
+	c.Assert(f.String(), Equals, "qux")
+
+	ret, err = f.Seek(-5, os.SEEK_END)
+	c.Assert(err, IsNil)
+	c.Assert(ret, Equals, int64(4))
+	c.Assert(f.String(), Equals, "arqux")
+
+	_, err = f.Seek(-10, os.SEEK_END)
+	c.Assert(err, FitsTypeOf, &os.PathError{})
+
+	_, err = f.Seek(0, 42)
+	c.Assert(err, FitsTypeOf, &os.PathError{})
+}
+
+func (s *FSSuite) TestFile_ReadCorrupted(c *C) {
+	f, _ := s.a.Create("foo")
+	f.inode.BlockSize = 3
+	f.WriteString("foobarqux")
+	f.Close()
+
+	s.a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blocksBucket)
+		id := getBlockId(getFile(tx, []byte("/foo")), 1)
+		raw := append([]byte(nil), b.Get(id)...)
+		raw[len(raw)-1]++
+
+		return b.Put(id, raw)
+	})
+
+	f, _ = s.a.Open("foo")
+	content := make([]byte, 9)
+	n, err := f.Read(content)
+	c.Assert(n, Equals, 3)
+	c.Assert(err, FitsTypeOf, &os.PathError{})
+	c.Assert(err.(*os.PathError).Err, DeepEquals, &CorruptBlockError{"/foo", 1})
+	c.Assert(err.(*os.PathError).Err.Error(), Equals, "corrupt block 1 of /foo: block checksum mismatch")
+}
+
 func (s *FSSuite) TestFile_ReadInClosed(c *C) {
 	f, _ := s.a.Create("foo")
 	f.Close()
@@ -154,3 +672,21 @@ func (s *FSSuite) TestFile_Close(c *C) {
 	err = f.Close()
 	c.Assert(err, IsNil)
 }
+
+func (s *FSSuite) TestFile_ManyBlocks(c *C) {
+	content := strings.Repeat("0123456789abc", 5)
+
+	f, _ := s.a.Create("/foo")
+	f.inode.BlockSize = 3
+	f.WriteString(content)
+	c.Assert(f.Close(), IsNil)
+
+	f, _ = s.a.Open("/foo")
+	c.Assert(f.String(), Equals, content)
+
+	s.a.db.View(func(tx *bolt.Tx) error {
+		k, _ := getFile(tx, []byte("/foo")).Bucket(indexBucket).Cursor().Last()
+		c.Assert(k, DeepEquals, blockKey(21))
+		return nil
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path"
@@ -13,25 +14,53 @@ import (
 var (
 	InodeSignature      = []byte{'R', 'A', 'A'}
 	WrongInodeSignature = errors.New("Wrong Inode signature")
+	WrongInodeLength    = errors.New("Wrong Inode length")
+	WrongInodeBlocks    = errors.New("Wrong Inode block count")
 )
 
 const (
-	InodeVersion int32 = 1
-	InodeLength  int32 = 64
+	InodeVersion int32 = 2
+	InodeLength  int32 = 113
+
+	// length of the version 1 inodes, the original layout
+	inodeV1Length int32 = 64
 )
 
+// InodeVersionError is returned reading an inode written with a version not
+// supported by this package, probably by a newer version of it
+type InodeVersionError struct {
+	Version int32
+}
+
+func (e *InodeVersionError) Error() string {
+	return fmt.Sprintf("unsupported inode version %d, max. supported %d", e.Version, InodeVersion)
+}
+
 type Inode struct {
 	Id           uint64
 	BlockSize    int32
 	Mode         os.FileMode
+	Flags        uint32
+	Codec        CodecId
+	Links        uint32
 	UserId       uint64
 	GroupId      uint64
 	Size         int64
 	ModifcatedAt time.Time
+	ChangedAt    time.Time
+	AccessedAt   time.Time
 	CreatedAt    time.Time
+	// Blocks is the number of blocks of the file when was written, the block
+	// index of a file has exactly one block per each BlockSize bytes
+	Blocks uint64
+
+	// extra holds the trailing bytes of the fields unknown to this version,
+	// written by a newer minor revision, they are kept on rewrite
+	extra []byte
 }
 
-// Write writes the byte representation of Inode
+// Write writes the byte representation of Inode, always using the current
+// version of the format.
 //
 // Inode byte representation on LittleEndian have the following format:
 // - 4-byte signature: The signature is: {'R', 'A', 'A'}
@@ -40,39 +69,59 @@ type Inode struct {
 // - 8-byte inode id
 // - 4-byte block size
 // - 4-byte file mode
+// - 4-byte flags
+// - 1-byte codec id, used to write new blocks
+// - 4-byte link count, the number of names pointing to the inode
 // - 8-byte user id
 // - 8-byte group id
 // - 8-byte file size
-// - 8-byte modification timestamp
-// - 8-byte creation timestamp
+// - 12-byte modification timestamp, 8-byte seconds and 4-byte nanoseconds
+// - 12-byte status change timestamp
+// - 12-byte access timestamp
+// - 12-byte creation timestamp
+// - 8-byte block count
+// - n-byte unknown fields, appended by newer revisions of the version
+//
+// New fields can be appended keeping the version, older readers keep them
+// untouched, any other change requires a new version.
 func (i *Inode) Write(w io.Writer) error {
 	if _, err := w.Write(InodeSignature); err != nil {
 		return err
 	}
 
 	var data = []interface{}{
-		InodeLength,
+		InodeLength + int32(len(i.extra)),
 		InodeVersion,
 		i.Id,
 		i.BlockSize,
 		i.Mode,
+		i.Flags,
+		i.Codec,
+		i.Links,
 		i.UserId,
 		i.GroupId,
 		i.Size,
-		i.ModifcatedAt.Unix(),
-		i.CreatedAt.Unix(),
 	}
 
+	for _, t := range []time.Time{i.ModifcatedAt, i.ChangedAt, i.AccessedAt, i.CreatedAt} {
+		data = append(data, t.Unix(), int32(t.Nanosecond()))
+	}
+
+	data = append(data, i.Blocks)
+
 	for _, v := range data {
 		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	_, err := w.Write(i.extra)
+	return err
 }
 
-// Read reads from a reader the byte representation of Inode and fills up the Inode
+// Read reads from a reader the byte representation of Inode and fills up the
+// Inode, any supported version is accepted. An InodeVersionError is returned
+// if the version is unknown.
 func (i *Inode) Read(r io.Reader) error {
 	sig := make([]byte, 3)
 	if _, err := r.Read(sig); err != nil {
@@ -88,59 +137,137 @@ func (i *Inode) Read(r io.Reader) error {
 		return err
 	}
 
-	var version int32
-	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
-		return err
+	if length < inodeV1Length {
+		return WrongInodeLength
 	}
 
-	if err := binary.Read(r, binary.LittleEndian, &i.Id); err != nil {
+	raw := make([]byte, length-4)
+	if _, err := io.ReadFull(r, raw); err != nil {
 		return err
 	}
 
-	if err := binary.Read(r, binary.LittleEndian, &i.BlockSize); err != nil {
-		return err
+	version := int32(binary.LittleEndian.Uint32(raw))
+	switch version {
+	case 1:
+		return i.readV1(bytes.NewReader(raw[4:]))
+	case 2:
+		if length < InodeLength {
+			return WrongInodeLength
+		}
+
+		return i.readV2(bytes.NewReader(raw[4:]))
+	default:
+		return &InodeVersionError{version}
 	}
+}
 
-	if err := binary.Read(r, binary.LittleEndian, &i.Mode); err != nil {
-		return err
+func (i *Inode) readV2(r *bytes.Reader) error {
+	var data = []interface{}{
+		&i.Id,
+		&i.BlockSize,
+		&i.Mode,
+		&i.Flags,
+		&i.Codec,
+		&i.Links,
+		&i.UserId,
+		&i.GroupId,
+		&i.Size,
 	}
 
-	if err := binary.Read(r, binary.LittleEndian, &i.UserId); err != nil {
-		return err
+	for _, v := range data {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return err
+		}
 	}
 
-	if err := binary.Read(r, binary.LittleEndian, &i.GroupId); err != nil {
-		return err
+	for _, t := range []*time.Time{&i.ModifcatedAt, &i.ChangedAt, &i.AccessedAt, &i.CreatedAt} {
+		var err error
+		if *t, err = readTimestamp(r); err != nil {
+			return err
+		}
 	}
 
-	if err := binary.Read(r, binary.LittleEndian, &i.Size); err != nil {
+	if err := binary.Read(r, binary.LittleEndian, &i.Blocks); err != nil {
 		return err
 	}
 
-	var modTs int64
+	i.extra = nil
+	if r.Len() > 0 {
+		i.extra = make([]byte, r.Len())
+		r.Read(i.extra)
+	}
+
+	return nil
+}
+
+// readV1 reads the original layout, without flags, codec, link count and
+// block count, and with seconds timestamps.
+func (i *Inode) readV1(r *bytes.Reader) error {
+	var data = []interface{}{
+		&i.Id,
+		&i.BlockSize,
+		&i.Mode,
+		&i.UserId,
+		&i.GroupId,
+		&i.Size,
+	}
+
+	for _, v := range data {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+
+	var modTs, creTs int64
 	if err := binary.Read(r, binary.LittleEndian, &modTs); err != nil {
 		return err
 	}
 
-	i.ModifcatedAt = time.Unix(modTs, 0)
-
-	var creTs int64
 	if err := binary.Read(r, binary.LittleEndian, &creTs); err != nil {
 		return err
 	}
 
+	i.Flags = 0
+	i.Codec = DefaultCodec
+	i.Links = 1
+	i.ModifcatedAt = time.Unix(modTs, 0)
+	i.ChangedAt = i.ModifcatedAt
+	i.AccessedAt = i.ModifcatedAt
 	i.CreatedAt = time.Unix(creTs, 0)
+	i.Blocks = i.blockCount()
+	i.extra = nil
 
-	if leftover := length - InodeLength; leftover != 0 {
-		raw := make([]byte, leftover)
-		if _, err := r.Read(raw); err != nil {
-			return err
-		}
+	return nil
+}
+
+func readTimestamp(r io.Reader) (time.Time, error) {
+	var sec int64
+	if err := binary.Read(r, binary.LittleEndian, &sec); err != nil {
+		return time.Time{}, err
 	}
 
-	return nil
+	var nsec int32
+	if err := binary.Read(r, binary.LittleEndian, &nsec); err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(sec, int64(nsec)), nil
+}
+
+// blockCount returns the number of blocks required to store the file content
+func (i *Inode) blockCount() uint64 {
+	if i.Size <= 0 || i.BlockSize <= 0 {
+		return 0
+	}
+
+	return uint64((i.Size + int64(i.BlockSize) - 1) / int64(i.BlockSize))
 }
 
+// implicitDirInode is the inode of the directories without entry at the
+// archive, as the root directory or the ones created by files imported from a
+// tar without his parent
+var implicitDirInode = Inode{Mode: os.ModeDir | 0755}
+
 type FileInfo struct {
 	name  string
 	inode Inode
@@ -166,9 +293,9 @@ func (fi *FileInfo) ModTime() time.Time {
 	return fi.inode.ModifcatedAt
 }
 
-// IsDir is present just for match the interface
+// IsDir reports whether fi describes a directory
 func (fi *FileInfo) IsDir() bool {
-	return false
+	return fi.inode.Mode.IsDir()
 }
 
 // Sys returns the Inode value
@@ -2,7 +2,9 @@ package raa
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"os"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -33,6 +35,14 @@ func (s *FSSuite) TestInode_WriteRead(c *C) {
 	c.Assert(i.Size, Equals, o.Size)
 	c.Assert(i.ModifcatedAt.Unix(), Equals, o.ModifcatedAt.Unix())
 	c.Assert(i.CreatedAt.Unix(), Equals, o.CreatedAt.Unix())
+	c.Assert(i.Links, Equals, o.Links)
+	c.Assert(i.Flags, Equals, o.Flags)
+	c.Assert(i.Codec, Equals, o.Codec)
+	c.Assert(i.Blocks, Equals, o.Blocks)
+	c.Assert(o.ModifcatedAt.Equal(i.ModifcatedAt), Equals, true)
+	c.Assert(o.CreatedAt.Equal(i.CreatedAt), Equals, true)
+	c.Assert(o.AccessedAt.Equal(i.AccessedAt), Equals, true)
+	c.Assert(o.ChangedAt.Equal(i.ChangedAt), Equals, true)
 
 	c.Assert(buf.String(), Equals, "FOO")
 }
@@ -58,6 +68,76 @@ func (s *FSSuite) TestInode_WriteReadWithLeftover(c *C) {
 	c.Assert(buf.String(), Equals, "")
 }
 
+func (s *FSSuite) TestInode_ReadV1(c *C) {
+	raw, _ := hex.DecodeString(inodeWithLeftover)
+	raw = raw[:len(InodeSignature)+64]
+	raw[len(InodeSignature)] = 64
+
+	o := &Inode{}
+	c.Assert(o.Read(bytes.NewBuffer(raw)), IsNil)
+	c.Assert(o.Size, Equals, int64(42*5))
+	c.Assert(o.Codec, Equals, DefaultCodec)
+	c.Assert(o.Links, Equals, uint32(1))
+	c.Assert(o.AccessedAt.Unix(), Equals, o.ModifcatedAt.Unix())
+
+	buf := bytes.NewBuffer(nil)
+	c.Assert(o.Write(buf), IsNil)
+	c.Assert(buf.Len(), Equals, int(InodeLength)+len(InodeSignature))
+
+	u := &Inode{}
+	c.Assert(u.Read(buf), IsNil)
+	c.Assert(u.Size, Equals, int64(42*5))
+	c.Assert(u.ModifcatedAt.Equal(o.ModifcatedAt), Equals, true)
+}
+
+func (s *FSSuite) TestInode_UnknownFields(c *C) {
+	buf := bytes.NewBuffer(nil)
+	getInodeFixture().Write(buf)
+
+	raw := append(buf.Bytes(), []byte("newfield")...)
+	binary.LittleEndian.PutUint32(raw[len(InodeSignature):], uint32(InodeLength+8))
+	raw = append(raw, []byte("FOO")...)
+
+	buf = bytes.NewBuffer(raw)
+	o := &Inode{}
+	c.Assert(o.Read(buf), IsNil)
+	c.Assert(o.Size, Equals, int64(42*5))
+	c.Assert(buf.String(), Equals, "FOO")
+
+	o.Size = 42
+	buf = bytes.NewBuffer(nil)
+	c.Assert(o.Write(buf), IsNil)
+	c.Assert(bytes.HasSuffix(buf.Bytes(), []byte("newfield")), Equals, true)
+
+	u := &Inode{}
+	c.Assert(u.Read(buf), IsNil)
+	c.Assert(u.Size, Equals, int64(42))
+	c.Assert(string(u.extra), Equals, "newfield")
+}
+
+func (s *FSSuite) TestInode_UnsupportedVersion(c *C) {
+	buf := bytes.NewBuffer(nil)
+	getInodeFixture().Write(buf)
+
+	raw := buf.Bytes()
+	binary.LittleEndian.PutUint32(raw[len(InodeSignature)+4:], 3)
+
+	err := (&Inode{}).Read(bytes.NewBuffer(raw))
+	c.Assert(err, DeepEquals, &InodeVersionError{3})
+	c.Assert(err.Error(), Equals, "unsupported inode version 3, max. supported 2")
+}
+
+func (s *FSSuite) TestInode_WrongLength(c *C) {
+	buf := bytes.NewBuffer(nil)
+	getInodeFixture().Write(buf)
+
+	raw := buf.Bytes()
+	binary.LittleEndian.PutUint32(raw[len(InodeSignature):], 80)
+
+	err := (&Inode{}).Read(bytes.NewBuffer(raw))
+	c.Assert(err, Equals, WrongInodeLength)
+}
+
 func (s *FSSuite) TestFileInfo_Name(c *C) {
 	f := &FileInfo{"/foo/bar", Inode{}}
 	c.Assert(f.Name(), Equals, "bar")
@@ -78,6 +158,9 @@ func (s *FSSuite) TestFileInfo_Sys(c *C) {
 func (s *FSSuite) TestFileInfo_IsDir(c *C) {
 	f := &FileInfo{"", Inode{}}
 	c.Assert(f.IsDir(), Equals, false)
+
+	f = &FileInfo{"", Inode{Mode: os.ModeDir | 0755}}
+	c.Assert(f.IsDir(), Equals, true)
 }
 
 func getInodeFixture() *Inode {
@@ -85,10 +168,16 @@ func getInodeFixture() *Inode {
 		Id:           42,
 		BlockSize:    42 * 2,
 		Mode:         0042,
+		Flags:        42 * 11,
+		Codec:        ZstdCodec,
 		UserId:       42 * 3,
 		GroupId:      42 * 4,
 		Size:         42 * 5,
 		ModifcatedAt: time.Now(),
 		CreatedAt:    time.Unix(42, 42),
+		Links:        42 * 6,
+		AccessedAt:   time.Unix(42*7, 42*8),
+		ChangedAt:    time.Unix(42*9, 42*10),
+		Blocks:       42 * 12,
 	}
 }
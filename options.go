@@ -0,0 +1,78 @@
+package raa
+
+import (
+	"os"
+	"time"
+)
+
+// ArchiveOptions represents the options used creating or opening an archive
+type ArchiveOptions struct {
+	// Timeout is the amount of time to wait to obtain the file lock, when
+	// set to zero it will wait indefinitely
+	Timeout time.Duration
+	// Mode is the permission of the archive file when is created, 0600 if zero
+	Mode os.FileMode
+	// MmapSize is the initial size in bytes of the memory map of the archive,
+	// read transactions don't block the writes while the archive fits on it
+	MmapSize int
+	// NoSync skips the fsync after each commit, a crash may corrupt the
+	// archive, useful for bulk loading that can be restarted
+	NoSync bool
+	// NoGrowSync skips the truncate call when the archive grows
+	NoGrowSync bool
+	// BlockSize is the default block size of the new files, written to the
+	// meta when the archive is created and ignored when is opened, see
+	// SetBlockSize. DefaultBlockSize if zero.
+	BlockSize int32
+	// Codec is the default codec of the new files, written to the meta when
+	// the archive is created and ignored when is opened, see SetCodec.
+	// DefaultCodec if zero.
+	Codec CodecId
+	// ReadOnly opens the archive in read-only mode with a shared lock, any
+	// write fails with ReadOnlyErr
+	ReadOnly bool
+	// Umask is cleared from the permission of the files and directories
+	// created by OpenFile, Create and Mkdir
+	Umask os.FileMode
+}
+
+// DefaultArchiveOptions are the options used by CreateArchive and OpenArchive
+var DefaultArchiveOptions = &ArchiveOptions{
+	Mode:      0600,
+	MmapSize:  2,
+	BlockSize: DefaultBlockSize,
+	Codec:     DefaultCodec,
+}
+
+func (o *ArchiveOptions) validate() error {
+	if o.BlockSize < 0 {
+		return InvalidBlockSizeErr
+	}
+
+	_, err := GetCodec(o.codec())
+	return err
+}
+
+func (o *ArchiveOptions) mode() os.FileMode {
+	if o.Mode == 0 {
+		return 0600
+	}
+
+	return o.Mode
+}
+
+func (o *ArchiveOptions) blockSize() int32 {
+	if o.BlockSize == 0 {
+		return DefaultBlockSize
+	}
+
+	return o.BlockSize
+}
+
+func (o *ArchiveOptions) codec() CodecId {
+	if o.Codec == 0 {
+		return DefaultCodec
+	}
+
+	return o.Codec
+}
@@ -0,0 +1,99 @@
+package raa
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *FSSuite) TestCreateArchiveWithOptions(c *C) {
+	file := filepath.Join(filepath.Dir(s.file), "options.raa")
+	a, err := CreateArchiveWithOptions(file, &ArchiveOptions{
+		Mode:      0640,
+		BlockSize: 1024,
+		Codec:     ZstdCodec,
+		NoSync:    true,
+	})
+
+	c.Assert(err, IsNil)
+	a.Close()
+
+	fi, err := os.Stat(file)
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0640))
+
+	a, err = OpenArchiveWithOptions(file, &ArchiveOptions{BlockSize: 42})
+	c.Assert(err, IsNil)
+	defer a.Close()
+
+	c.Assert(a.BlockSize(), Equals, int32(1024))
+	c.Assert(a.Codec(), Equals, ZstdCodec)
+}
+
+func (s *FSSuite) TestCreateArchiveWithOptions_Defaults(c *C) {
+	file := filepath.Join(filepath.Dir(s.file), "options.raa")
+	a, err := CreateArchiveWithOptions(file, &ArchiveOptions{NoSync: true})
+	c.Assert(err, IsNil)
+	defer a.Close()
+
+	c.Assert(a.BlockSize(), Equals, DefaultBlockSize)
+	c.Assert(a.Codec(), Equals, DefaultCodec)
+}
+
+func (s *FSSuite) TestCreateArchiveWithOptions_NoneCodec(c *C) {
+	file := filepath.Join(filepath.Dir(s.file), "options.raa")
+	a, err := CreateArchiveWithOptions(file, &ArchiveOptions{Codec: NoneCodec})
+	c.Assert(err, IsNil)
+	defer a.Close()
+
+	c.Assert(a.Codec(), Equals, NoneCodec)
+}
+
+func (s *FSSuite) TestCreateArchiveWithOptions_Invalid(c *C) {
+	file := filepath.Join(filepath.Dir(s.file), "options.raa")
+
+	_, err := CreateArchiveWithOptions(file, &ArchiveOptions{BlockSize: -1})
+	c.Assert(err, Equals, InvalidBlockSizeErr)
+
+	_, err = CreateArchiveWithOptions(file, &ArchiveOptions{Codec: 42})
+	c.Assert(err, Equals, UnknownCodecErr)
+
+	_, err = CreateArchiveWithOptions(file, &ArchiveOptions{ReadOnly: true})
+	c.Assert(err, Equals, ReadOnlyErr)
+}
+
+func (s *FSSuite) TestOpenArchiveWithOptions_Timeout(c *C) {
+	_, err := OpenArchiveWithOptions(s.file, &ArchiveOptions{
+		Timeout: 10 * time.Millisecond,
+	})
+
+	c.Assert(err, NotNil)
+}
+
+func (s *FSSuite) TestOpenArchiveWithOptions_Umask(c *C) {
+	s.a.Close()
+
+	a, err := OpenArchiveWithOptions(s.file, &ArchiveOptions{Umask: 022})
+	c.Assert(err, IsNil)
+	s.a = a
+
+	f, _ := a.Create("/foo")
+	f.Close()
+	c.Assert(a.Mkdir("/bar", 0777), IsNil)
+	c.Assert(a.Symlink("/foo", "/qux"), IsNil)
+
+	fi, _ := a.Stat("/foo")
+	c.Assert(fi.Mode(), Equals, os.FileMode(0644))
+
+	fi, _ = a.Stat("/bar")
+	c.Assert(fi.Mode(), Equals, os.ModeDir|0755)
+
+	fi, _ = a.Lstat("/qux")
+	c.Assert(fi.Mode(), Equals, os.ModeSymlink|0777)
+
+	c.Assert(a.Chmod("/foo", 0666), IsNil)
+	fi, _ = a.Stat("/foo")
+	c.Assert(fi.Mode(), Equals, os.FileMode(0666))
+}
@@ -0,0 +1,160 @@
+package raa
+
+import (
+	"errors"
+	"os"
+
+	"github.com/mcuadros/bolt"
+)
+
+var ReadOnlyErr = errors.New("cannot write on a read-only archive or transaction")
+
+// Tx is a transaction on an archive, every file opened, created, removed or
+// renamed through it shares the same bolt transaction, so the changes are
+// committed at once, or discarded if the transaction fails.
+type Tx struct {
+	a     *Archive
+	files []*File
+}
+
+// Update executes fn inside a read-write transaction, the changes are committed
+// when fn returns nil and rolled back if returns an error. The files opened
+// in the transaction and not closed by fn are synced and closed before commit,
+// they cannot be used after Update returns. The archive itself should not be
+// used inside fn, only the given Tx.
+func (a *Archive) Update(fn func(tx *Tx) error) error {
+	if a.readOnly {
+		return ReadOnlyErr
+	}
+
+	return a.db.Update(func(btx *bolt.Tx) error {
+		tx := a.newTx(btx)
+		if err := fn(tx); err != nil {
+			tx.discard()
+			return err
+		}
+
+		return tx.close()
+	})
+}
+
+// View executes fn inside a read-only transaction, any write done through the
+// given Tx fails with ReadOnlyErr. The files opened in the transaction cannot
+// be used after View returns.
+func (a *Archive) View(fn func(tx *Tx) error) error {
+	return a.db.View(func(btx *bolt.Tx) error {
+		tx := a.newTx(btx)
+		defer tx.discard()
+
+		return fn(tx)
+	})
+}
+
+func (a *Archive) newTx(btx *bolt.Tx) *Tx {
+	bound := *a
+	bound.tx = btx
+
+	return &Tx{a: &bound}
+}
+
+// Create creates the named file inside the transaction, see Archive.Create.
+func (tx *Tx) Create(name string) (*File, error) {
+	return tx.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Open opens the named file for reading inside the transaction, see
+// Archive.Open.
+func (tx *Tx) Open(name string) (*File, error) {
+	return tx.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file inside the transaction, see Archive.OpenFile.
+func (tx *Tx) OpenFile(name string, flag int, perm os.FileMode) (*File, error) {
+	f, err := tx.a.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	tx.files = append(tx.files, f)
+	return f, nil
+}
+
+// Stat returns the FileInfo of the named file inside the transaction, see
+// Archive.Stat.
+func (tx *Tx) Stat(name string) (os.FileInfo, error) {
+	return tx.a.Stat(name)
+}
+
+// Mkdir creates a new directory inside the transaction, see Archive.Mkdir.
+func (tx *Tx) Mkdir(name string, perm os.FileMode) error {
+	return tx.a.Mkdir(name, perm)
+}
+
+// Remove removes the named file or directory inside the transaction, see
+// Archive.Remove.
+func (tx *Tx) Remove(name string) error {
+	return tx.a.Remove(name)
+}
+
+// RemoveAll removes path and any children it contains inside the transaction,
+// see Archive.RemoveAll.
+func (tx *Tx) RemoveAll(path string) (int, error) {
+	return tx.a.RemoveAll(path)
+}
+
+// Rename renames (moves) a file inside the transaction, see Archive.Rename.
+func (tx *Tx) Rename(oldpath, newpath string) error {
+	return tx.a.Rename(oldpath, newpath)
+}
+
+// close syncs and closes the files left open by the transaction
+func (tx *Tx) close() error {
+	for _, f := range tx.files {
+		if f.isClosed {
+			continue
+		}
+
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// discard closes the files opened by the transaction without syncing them
+func (tx *Tx) discard() {
+	for _, f := range tx.files {
+		f.isClosed = true
+	}
+}
+
+// view runs fn on the transaction bound to the archive, or in a new read-only
+// transaction if the archive is not bound to any.
+func (a *Archive) view(fn func(*bolt.Tx) error) error {
+	if a.tx != nil {
+		return fn(a.tx)
+	}
+
+	return a.db.View(fn)
+}
+
+// update runs fn on the transaction bound to the archive, or in a new
+// read-write transaction if the archive is not bound to any.
+func (a *Archive) update(fn func(*bolt.Tx) error) error {
+	if a.isReadOnly() {
+		return ReadOnlyErr
+	}
+
+	if a.tx != nil {
+		return fn(a.tx)
+	}
+
+	return a.db.Update(fn)
+}
+
+// isReadOnly returns true if the archive was opened in read-only mode or is
+// bound to a read-only transaction
+func (a *Archive) isReadOnly() bool {
+	return a.readOnly || (a.tx != nil && !a.tx.Writable())
+}
@@ -0,0 +1,108 @@
+package raa
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *FSSuite) TestArchive_Update(c *C) {
+	err := s.a.Update(func(tx *Tx) error {
+		for i := 0; i < 100; i++ {
+			f, err := tx.Create(fmt.Sprintf("/foo/%d", i))
+			if err != nil {
+				return err
+			}
+
+			f.WriteString(fmt.Sprintf("foo %d", i))
+			f.Close()
+		}
+
+		f, err := tx.Open("/foo/42")
+		c.Assert(err, IsNil)
+		c.Assert(f.String(), Equals, "foo 42")
+
+		return tx.Rename("/foo/42", "/bar")
+	})
+
+	c.Assert(err, IsNil)
+
+	files := s.a.Find(func(string) bool { return true })
+	c.Assert(files, HasLen, 100)
+
+	f, err := s.a.Open("/bar")
+	c.Assert(err, IsNil)
+	c.Assert(f.String(), Equals, "foo 42")
+}
+
+func (s *FSSuite) TestArchive_UpdateRollback(c *C) {
+	f, _ := s.a.Create("/foo")
+	f.WriteString("foo")
+	f.Close()
+
+	failure := errors.New("failure")
+	err := s.a.Update(func(tx *Tx) error {
+		f, _ := tx.Create("/bar")
+		f.WriteString("bar")
+		f.Close()
+
+		c.Assert(tx.Remove("/foo"), IsNil)
+		return failure
+	})
+
+	c.Assert(err, Equals, failure)
+
+	_, err = s.a.Stat("/bar")
+	c.Assert(err, NotNil)
+
+	f, err = s.a.Open("/foo")
+	c.Assert(err, IsNil)
+	c.Assert(f.String(), Equals, "foo")
+}
+
+func (s *FSSuite) TestArchive_UpdateSyncsOpenFiles(c *C) {
+	var f *File
+	err := s.a.Update(func(tx *Tx) error {
+		var err error
+		f, err = tx.Create("/foo")
+		f.WriteString("foo")
+		return err
+	})
+
+	c.Assert(err, IsNil)
+
+	_, err = f.WriteString("bar")
+	c.Assert(err, NotNil)
+
+	f, err = s.a.Open("/foo")
+	c.Assert(err, IsNil)
+	c.Assert(f.String(), Equals, "foo")
+}
+
+func (s *FSSuite) TestArchive_View(c *C) {
+	f, _ := s.a.Create("/foo")
+	f.WriteString("foo")
+	f.Close()
+
+	err := s.a.View(func(tx *Tx) error {
+		f, err := tx.Open("/foo")
+		c.Assert(err, IsNil)
+		c.Assert(f.String(), Equals, "foo")
+
+		fi, err := tx.Stat("/foo")
+		c.Assert(err, IsNil)
+		c.Assert(fi.Size(), Equals, int64(3))
+
+		_, err = tx.Create("/bar")
+		c.Assert(err.(*os.PathError).Err, Equals, ReadOnlyErr)
+
+		return tx.Remove("/foo")
+	})
+
+	c.Assert(err.(*os.PathError).Err, Equals, ReadOnlyErr)
+
+	_, err = s.a.Stat("/bar")
+	c.Assert(err, NotNil)
+}
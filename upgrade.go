@@ -0,0 +1,286 @@
+package raa
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+
+	"code.google.com/p/snappy-go/snappy"
+	"github.com/mcuadros/bolt"
+)
+
+// layout of the version 1 files, only read by UpgradeArchive
+const v1BlockPattern = "block.%d"
+
+var v1BlockInode = []byte("block.inode")
+
+// upgradeTimeout is the time UpgradeArchive waits for the lock of an archive
+// opened by other process
+const upgradeTimeout = 10 * time.Second
+
+// UpgradeArchive rewrites an archive written with a previous format version
+// into the current layout. Archives already in the current format are not
+// modified.
+//
+// The version 1 archives have no meta, only a root bucket with a bucket per
+// file holding the inode and the snappy compressed blocks. Every file is
+// upgraded in his own transaction, the archive is marked as version 1 until
+// the last one is committed, so an interrupted upgrade is resumed by calling
+// UpgradeArchive again.
+func UpgradeArchive(dbFile string) error {
+	opts := *DefaultArchiveOptions
+	opts.Timeout = upgradeTimeout
+
+	return UpgradeArchiveWithOptions(dbFile, &opts)
+}
+
+// UpgradeArchiveWithOptions is like UpgradeArchive but using the given
+// options, nil options are the DefaultArchiveOptions
+func UpgradeArchiveWithOptions(dbFile string, opts *ArchiveOptions) error {
+	if opts == nil {
+		opts = DefaultArchiveOptions
+	}
+
+	if opts.ReadOnly {
+		return ReadOnlyErr
+	}
+
+	if _, err := os.Stat(dbFile); err != nil {
+		return notFoundError
+	}
+
+	db, err := bolt.Open(dbFile, opts.mode(), &bolt.Options{
+		Timeout:     opts.Timeout,
+		MinMmapSize: opts.MmapSize,
+		NoGrowSync:  opts.NoGrowSync,
+	})
+	if err == bolt.ErrInvalid {
+		return &ArchiveFormatError{Path: dbFile}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+	db.NoSync = opts.NoSync
+
+	var version uint32
+	db.View(func(tx *bolt.Tx) error {
+		version = archiveFormat(tx)
+		return nil
+	})
+
+	switch version {
+	case FormatVersion:
+		return nil
+	case 1:
+		return upgradeV1(db)
+	default:
+		return &ArchiveFormatError{Path: dbFile, Version: version}
+	}
+}
+
+// isBaselineArchive returns true if the archive has the layout of the version
+// 1, only a root bucket with a bucket per file
+func isBaselineArchive(tx *bolt.Tx) bool {
+	root := tx.Bucket(rootBucket)
+	if root == nil {
+		return false
+	}
+
+	baseline := true
+	tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if !bytes.Equal(name, rootBucket) {
+			baseline = false
+			return stopError
+		}
+
+		return nil
+	})
+
+	if !baseline {
+		return false
+	}
+
+	k, v := root.Cursor().First()
+	return k == nil || v == nil
+}
+
+// upgradeV1 moves every file of the root bucket to a new inode, one file per
+// transaction, the meta of the current format is written once all the files
+// are moved
+func upgradeV1(db *bolt.DB) error {
+	var names [][]byte
+	err := db.Update(func(tx *bolt.Tx) error {
+		tx.Bucket(rootBucket).ForEach(func(k, v []byte) error {
+			if v == nil {
+				names = append(names, append([]byte(nil), k...))
+			}
+
+			return nil
+		})
+
+		return markUpgradeV1(tx)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err := db.Update(func(tx *bolt.Tx) error {
+			return upgradeV1File(tx, name)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return putMeta(tx, SnappyCodec, DefaultBlockSize)
+	})
+}
+
+// markUpgradeV1 writes a meta recording the version 1, the archive is no
+// longer a baseline archive once the first file is moved
+func markUpgradeV1(tx *bolt.Tx) error {
+	b, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+
+	format := make([]byte, 4)
+	binary.BigEndian.PutUint32(format, 1)
+
+	if err := b.Put(magicKey, ArchiveMagic); err != nil {
+		return err
+	}
+
+	return b.Put(formatKey, format)
+}
+
+// upgradeV1File moves a file to a new inode, the content of the file is split
+// again in blocks and stored at the blocks bucket. The files already moved
+// are skipped.
+func upgradeV1File(tx *bolt.Tx, name []byte) error {
+	root := tx.Bucket(rootBucket)
+	old := root.Bucket(name)
+	if old == nil {
+		return nil
+	}
+
+	inodes, err := tx.CreateBucketIfNotExists(inodesBucket)
+	if err != nil {
+		return err
+	}
+
+	i := &Inode{}
+	if err := i.Read(bytes.NewBuffer(old.Get(v1BlockInode))); err != nil {
+		return err
+	}
+
+	if i.Id, err = inodes.NextSequence(); err != nil {
+		return err
+	}
+
+	if i.BlockSize <= 0 {
+		i.BlockSize = DefaultBlockSize
+	}
+
+	file, err := inodes.CreateBucket(inodeKey(i.Id))
+	if err != nil {
+		return err
+	}
+
+	index, err := file.CreateBucket(indexBucket)
+	if err != nil {
+		return err
+	}
+
+	a := &Archive{}
+	if err := a.copyV1Blocks(tx, old, index, i); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+
+	if err := putInode(file, i); err != nil {
+		return err
+	}
+
+	if err := root.DeleteBucket(name); err != nil {
+		return err
+	}
+
+	return root.Put(name, inodeKey(i.Id))
+}
+
+// copyV1Blocks stores the content of a version 1 file split again in blocks
+// of the block size of the inode, only one block of the old file is decoded at
+// a time. The old blocks are read by his number, not by his key, so "block.10"
+// goes after "block.9".
+func (a *Archive) copyV1Blocks(tx *bolt.Tx, old, index *bolt.Bucket, i *Inode) error {
+	size := int(i.BlockSize)
+	buf := make([]byte, 0, size)
+
+	var read int64
+	var n int
+	flush := func() error {
+		id, err := a.putBlock(tx, buf, i.Id, n, i.Codec, false)
+		if err != nil {
+			return err
+		}
+
+		if err := index.Put(blockKey(n), id); err != nil {
+			return err
+		}
+
+		n++
+		buf = buf[:0]
+		return nil
+	}
+
+	for m := 0; read < i.Size; m++ {
+		v := old.Get([]byte(fmt.Sprintf(v1BlockPattern, m)))
+		if v == nil {
+			return missingBlockError
+		}
+
+		block, err := snappy.Decode(nil, v)
+		if err != nil {
+			return err
+		}
+
+		if left := i.Size - read; int64(len(block)) > left {
+			block = block[:left]
+		}
+
+		read += int64(len(block))
+		for len(block) > 0 {
+			chunk := size - len(buf)
+			if chunk > len(block) {
+				chunk = len(block)
+			}
+
+			buf = append(buf, block[:chunk]...)
+			block = block[chunk:]
+
+			if len(buf) == size {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if len(buf) > 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	i.Blocks = i.blockCount()
+	return nil
+}
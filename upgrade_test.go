@@ -0,0 +1,135 @@
+package raa
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.google.com/p/snappy-go/snappy"
+	"github.com/mcuadros/bolt"
+	. "gopkg.in/check.v1"
+)
+
+func (s *FSSuite) TestUpgradeArchive_V1(c *C) {
+	s.a.Close()
+	os.Remove(s.file)
+
+	content := strings.Repeat("0123456789abc", 5)
+	db, err := bolt.Open(s.file, 0600, nil)
+	c.Assert(err, IsNil)
+
+	db.Update(func(tx *bolt.Tx) error {
+		root, _ := tx.CreateBucket(rootBucket)
+		writeV1File(root, "/foo", content, 3)
+		writeV1File(root, "/bar", "", 3)
+		return nil
+	})
+
+	db.Close()
+
+	_, err = OpenArchive(s.file)
+	c.Assert(err, DeepEquals, &ArchiveFormatError{Path: s.file, Version: 1})
+
+	c.Assert(UpgradeArchive(s.file), IsNil)
+	c.Assert(UpgradeArchive(s.file), IsNil)
+
+	s.a, err = OpenArchive(s.file)
+	c.Assert(err, IsNil)
+	c.Assert(s.a.Format(), Equals, FormatVersion)
+
+	f, err := s.a.Open("/foo")
+	c.Assert(err, IsNil)
+	c.Assert(f.String(), Equals, content)
+	c.Assert(f.inode.Blocks, Equals, uint64(22))
+	c.Assert(countBlocks(s.a), Equals, 22)
+
+	fi, _ := f.Stat()
+	c.Assert(fi.Mode(), Equals, os.FileMode(0640))
+	c.Assert(fi.ModTime().Unix(), Equals, int64(1428601174))
+
+	fi, err = s.a.Stat("/bar")
+	c.Assert(err, IsNil)
+	c.Assert(fi.Size(), Equals, int64(0))
+}
+
+func writeV1File(root *bolt.Bucket, name, content string, blockSize int32) {
+	b, _ := root.CreateBucket([]byte(name))
+
+	buf := bytes.NewBuffer(InodeSignature)
+	for _, v := range []interface{}{
+		int32(64), int32(1), uint64(0), blockSize, os.FileMode(0640),
+		uint64(1000), uint64(1000), int64(len(content)),
+		int64(1428601174), int64(1428601174),
+	} {
+		binary.Write(buf, binary.LittleEndian, v)
+	}
+
+	b.Put(v1BlockInode, buf.Bytes())
+
+	for n := 0; n*int(blockSize) <= len(content); n++ {
+		block := content[n*int(blockSize):]
+		if len(block) > int(blockSize) {
+			block = block[:blockSize]
+		}
+
+		enc, _ := snappy.Encode(nil, []byte(block))
+		b.Put([]byte(fmt.Sprintf(v1BlockPattern, n)), enc)
+	}
+}
+
+func (s *FSSuite) TestUpgradeArchive_Resume(c *C) {
+	s.a.Close()
+	os.Remove(s.file)
+
+	db, err := bolt.Open(s.file, 0600, nil)
+	c.Assert(err, IsNil)
+
+	db.Update(func(tx *bolt.Tx) error {
+		root, _ := tx.CreateBucket(rootBucket)
+		writeV1File(root, "/foo", "foo", 3)
+		writeV1File(root, "/bar", "bar", 3)
+		return nil
+	})
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := markUpgradeV1(tx); err != nil {
+			return err
+		}
+
+		return upgradeV1File(tx, []byte("/foo"))
+	})
+
+	c.Assert(err, IsNil)
+	db.Close()
+
+	_, err = OpenArchive(s.file)
+	c.Assert(err, DeepEquals, &ArchiveFormatError{Path: s.file, Version: 1})
+
+	c.Assert(UpgradeArchive(s.file), IsNil)
+
+	s.a, err = OpenArchive(s.file)
+	c.Assert(err, IsNil)
+
+	for _, name := range []string{"foo", "bar"} {
+		f, err := s.a.Open(name)
+		c.Assert(err, IsNil)
+		c.Assert(f.String(), Equals, name)
+	}
+}
+
+func (s *FSSuite) TestUpgradeArchive_NotRaa(c *C) {
+	file := filepath.Join(filepath.Dir(s.file), "foo.db")
+	db, _ := bolt.Open(file, 0600, nil)
+	db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("foo"))
+		return err
+	})
+
+	db.Close()
+
+	err := UpgradeArchive(file)
+	c.Assert(err, DeepEquals, &ArchiveFormatError{Path: file})
+}
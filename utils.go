@@ -5,10 +5,14 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 )
 
-// AddFile adds a OS file to a Volume, returns the number of bytes written
+// AddFile adds a OS file to a Volume, returns the number of bytes written. The
+// mode, owner, times and, on Linux, the extended attributes of the file are
+// preserved.
 func AddFile(a *Archive, from, to string) (int64, error) {
 	src, err := os.Open(from)
 	if err != nil {
@@ -27,24 +31,110 @@ func AddFile(a *Archive, from, to string) (int64, error) {
 	}
 
 	dst.Chmod(fi.Mode())
-	dst.Chown(
-		int(fi.Sys().(*syscall.Stat_t).Uid),
-		int(fi.Sys().(*syscall.Stat_t).Gid),
-	)
+	dst.Chown(fileOwner(fi))
 
 	defer dst.Close()
 
-	return io.Copy(dst, src)
+	xattrs, err := fileXattrs(from)
+	if err != nil {
+		return -1, err
+	}
+
+	for attr, value := range xattrs {
+		dst.Setxattr(attr, value)
+	}
+
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		return n, err
+	}
+
+	dst.Chtimes(fileAccessTime(fi), fi.ModTime())
+	return n, nil
+}
+
+func fileOwner(fi os.FileInfo) (uid, gid int) {
+	st := fi.Sys().(*syscall.Stat_t)
+	return int(st.Uid), int(st.Gid)
+}
+
+// addDirectoryEntry creates the directory, and any missing parent, with the
+// given mode, owner and modification time, an existing directory is updated
+func addDirectoryEntry(a *Archive, name string, mode os.FileMode, uid, gid int, mtime time.Time) error {
+	if err := a.MkdirAll(name, mode.Perm()); err != nil {
+		return err
+	}
+
+	dir, err := a.Open(name)
+	if err != nil {
+		return err
+	}
+
+	dir.Chmod(mode)
+	dir.Chown(uid, gid)
+	dir.Chtimes(mtime, mtime)
+
+	return dir.Close()
 }
 
-// AddFile adds a OS directory to a Volume, returns the number of files written
+// AddFile adds a OS directory to a Volume, returns the number of files written.
+// The hard links between the files are kept.
 func AddDirectory(a *Archive, from, to string, recursive bool) (int, error) {
 	return AddGlob(a, filepath.Join(from, "*"), to, recursive)
 }
 
-// AddGlob adds a OS files and directories to a Volume using a glob pattern,
-// returns the number of files written
+// fileId identifies a OS file by his device and inode
+type fileId struct {
+	dev, ino uint64
+}
+
+// addHardLink links to if the OS file was already added under other name, the
+// files with more than one link are recorded at links
+func addHardLink(a *Archive, fi os.FileInfo, to string, links map[fileId]string) (bool, error) {
+	st := fi.Sys().(*syscall.Stat_t)
+	if st.Nlink < 2 {
+		return false, nil
+	}
+
+	id := fileId{uint64(st.Dev), uint64(st.Ino)}
+	name, ok := links[id]
+	if !ok {
+		links[id] = to
+		return false, nil
+	}
+
+	a.Remove(to)
+	return true, a.Link(name, to)
+}
+
+// AddSymlink adds a OS symbolic link to a Volume, the link is not followed
+func AddSymlink(a *Archive, from, to string) error {
+	fi, err := os.Lstat(from)
+	if err != nil {
+		return err
+	}
+
+	link, err := os.Readlink(from)
+	if err != nil {
+		return err
+	}
+
+	if err := a.Symlink(link, to); err != nil {
+		return err
+	}
+
+	uid, gid := fileOwner(fi)
+	return a.Lchown(to, uid, gid)
+}
+
+// AddGlob adds a OS files, directories and symbolic links to a Volume using a
+// glob pattern, the links are not followed. Returns the number of files and
+// links written, the hard links between the files are kept.
 func AddGlob(a *Archive, pattern, to string, recursive bool) (int, error) {
+	return addGlob(a, pattern, to, recursive, make(map[fileId]string, 0))
+}
+
+func addGlob(a *Archive, pattern, to string, recursive bool, links map[fileId]string) (int, error) {
 	files, err := filepath.Glob(pattern)
 	if err != nil {
 		return -1, err
@@ -52,18 +142,37 @@ func AddGlob(a *Archive, pattern, to string, recursive bool) (int, error) {
 
 	count := 0
 	for _, file := range files {
-		fi, _ := os.Stat(file)
+		fi, _ := os.Lstat(file)
 		dst := filepath.Join(to, fi.Name())
 
 		switch {
 		case fi.Mode().IsRegular():
-			if _, err := AddFile(a, file, dst); err != nil {
+			linked, err := addHardLink(a, fi, dst, links)
+			if err != nil {
+				return count, err
+			}
+
+			if !linked {
+				if _, err := AddFile(a, file, dst); err != nil {
+					return count, err
+				}
+			}
+
+			count++
+		case fi.Mode()&os.ModeSymlink != 0:
+			if err := AddSymlink(a, file, dst); err != nil {
 				return count, err
 			}
 
 			count++
 		case fi.IsDir() && recursive:
-			n, err := AddDirectory(a, file, dst, recursive)
+			uid, gid := fileOwner(fi)
+			err := addDirectoryEntry(a, dst, fi.Mode(), uid, gid, fi.ModTime())
+			if err != nil {
+				return count, err
+			}
+
+			n, err := addGlob(a, filepath.Join(file, "*"), dst, recursive, links)
 			if n != -1 {
 				count += n
 			}
@@ -77,8 +186,9 @@ func AddGlob(a *Archive, pattern, to string, recursive bool) (int, error) {
 	return count, nil
 }
 
-// AddTarContent add the contained files in a tar stream to the volume, returns
-// the number of files copied to the Volume
+// AddTarContent add the contained files, directories, symbolic and hard links
+// in a tar stream to the volume, returns the number of files and links copied
+// to the Volume
 func AddTarContent(a *Archive, file io.Reader, to string) (int, error) {
 	reader := tar.NewReader(file)
 	count := 0
@@ -99,6 +209,37 @@ func AddTarContent(a *Archive, file io.Reader, to string) (int, error) {
 			}
 
 			count++
+		case tar.TypeSymlink:
+			name := filepath.Join(to, hdr.Name)
+			if err := a.Symlink(hdr.Linkname, name); err != nil {
+				return count, err
+			}
+
+			if err := a.Lchown(name, hdr.Uid, hdr.Gid); err != nil {
+				return count, err
+			}
+
+			count++
+		case tar.TypeLink:
+			oldname := filepath.Join(to, hdr.Linkname)
+			if err := a.Link(oldname, filepath.Join(to, hdr.Name)); err != nil {
+				return count, err
+			}
+
+			count++
+		case tar.TypeDir:
+			name := filepath.Join(to, hdr.Name)
+			mode := os.FileMode(hdr.Mode).Perm()
+			err := addDirectoryEntry(a, name, mode, hdr.Uid, hdr.Gid, hdr.ModTime)
+			if err != nil {
+				return count, err
+			}
+
+			for attr, value := range tarXattrs(hdr) {
+				if err := a.Setxattr(name, attr, value); err != nil {
+					return count, err
+				}
+			}
 		}
 	}
 
@@ -107,16 +248,26 @@ func AddTarContent(a *Archive, file io.Reader, to string) (int, error) {
 
 func readFileFromTar(a *Archive, reader *tar.Reader, h *tar.Header, to string) error {
 	file, err := createFileFromTarHeader(a, h, to)
-	defer file.Close()
 	if err != nil {
 		return err
 	}
 
 	if _, err = io.Copy(file, reader); err != nil {
+		file.Close()
 		return err
 	}
 
-	return nil
+	atime := h.AccessTime
+	if atime.IsZero() {
+		atime = h.ModTime
+	}
+
+	if err := file.Chtimes(atime, h.ModTime); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
 }
 
 func createFileFromTarHeader(a *Archive, h *tar.Header, to string) (*File, error) {
@@ -128,5 +279,24 @@ func createFileFromTarHeader(a *Archive, h *tar.Header, to string) (*File, error
 	file.Chown(h.Uid, h.Gid)
 	file.Chmod(os.FileMode(h.Mode))
 
+	for attr, value := range tarXattrs(h) {
+		file.Setxattr(attr, value)
+	}
+
 	return file, nil
 }
+
+// tarXattrPrefix is the prefix of the PAX records holding extended attributes
+const tarXattrPrefix = "SCHILY.xattr."
+
+// tarXattrs returns the extended attributes from the PAX records of a header
+func tarXattrs(h *tar.Header) map[string][]byte {
+	xattrs := make(map[string][]byte, 0)
+	for k, v := range h.PAXRecords {
+		if strings.HasPrefix(k, tarXattrPrefix) {
+			xattrs[k[len(tarXattrPrefix):]] = []byte(v)
+		}
+	}
+
+	return xattrs
+}
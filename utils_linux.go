@@ -0,0 +1,61 @@
+package raa
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"time"
+)
+
+func fileAccessTime(fi os.FileInfo) time.Time {
+	st := fi.Sys().(*syscall.Stat_t)
+	return time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+}
+
+// fileXattrs returns the extended attributes of a OS file, the filesystems
+// without support for them return no attributes
+func fileXattrs(path string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		if err == syscall.ENOTSUP {
+			err = nil
+		}
+
+		return nil, err
+	}
+
+	list := make([]byte, size)
+	if size, err = syscall.Listxattr(path, list); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte, 0)
+	for _, attr := range bytes.Split(list[:size], []byte{0}) {
+		if len(attr) == 0 {
+			continue
+		}
+
+		value, err := fileXattr(path, string(attr))
+		if err != nil {
+			return nil, err
+		}
+
+		xattrs[string(attr)] = value
+	}
+
+	return xattrs, nil
+}
+
+func fileXattr(path, attr string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, attr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, size)
+	if size, err = syscall.Getxattr(path, attr, value); err != nil {
+		return nil, err
+	}
+
+	return value[:size], nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package raa
+
+import (
+	"os"
+	"time"
+)
+
+// fileAccessTime returns the modification time, the access time is not
+// portable between systems
+func fileAccessTime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
+
+// fileXattrs returns no attributes, the extended attributes are only
+// supported on Linux
+func fileXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
@@ -1,10 +1,14 @@
 package raa
 
 import (
+	"archive/tar"
+	"bytes"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	. "gopkg.in/check.v1"
 )
@@ -29,6 +33,25 @@ func (s *FSSuite) TestAddFile(c *C) {
 	c.Assert(int(dst.inode.Mode), Equals, 0555)
 }
 
+func (s *FSSuite) TestAddFile_Times(c *C) {
+	src, err := ioutil.TempFile("/tmp/", "times_raa")
+	c.Assert(err, IsNil)
+	src.WriteString("foo")
+	src.Close()
+
+	atime := time.Unix(1429202449, 42)
+	mtime := time.Unix(1429202449, 123456789)
+	c.Assert(os.Chtimes(src.Name(), atime, mtime), IsNil)
+
+	_, err = AddFile(s.a, src.Name(), "/bar")
+	c.Assert(err, IsNil)
+
+	fi, err := s.a.Stat("/bar")
+	c.Assert(err, IsNil)
+	c.Assert(fi.ModTime().Equal(mtime), Equals, true)
+	c.Assert(fi.Sys().(Inode).AccessedAt.Equal(atime), Equals, true)
+}
+
 func (s *FSSuite) TestAddGlob(c *C) {
 	dir := makeDirFixture()
 
@@ -58,6 +81,169 @@ func (s *FSSuite) TestAddGlob_Rescursive(c *C) {
 	defer dst.Close()
 	c.Assert(err, IsNil)
 	c.Assert(dst.String(), Equals, "baz")
+
+	fi, err := s.a.Stat("/foo/baz")
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode(), Equals, os.ModeDir|0766&^umask())
+
+	fi, err = s.a.Stat("/foo/empty")
+	c.Assert(err, IsNil)
+	c.Assert(fi.IsDir(), Equals, true)
+}
+
+func (s *FSSuite) TestAddGlob_Symlink(c *C) {
+	dir := makeDirFixture()
+	os.Symlink("bar", filepath.Join(dir, "link"))
+	os.Symlink("baz", filepath.Join(dir, "dirlink"))
+
+	n, err := AddGlob(s.a, filepath.Join(dir, "*"), "foo", true)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 5)
+
+	link, err := s.a.Readlink("/foo/link")
+	c.Assert(err, IsNil)
+	c.Assert(link, Equals, "bar")
+
+	fi, err := s.a.Lstat("/foo/dirlink")
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode()&os.ModeSymlink, Not(Equals), os.FileMode(0))
+
+	dst, err := s.a.Open("/foo/dirlink/baz")
+	c.Assert(err, IsNil)
+	c.Assert(dst.String(), Equals, "baz")
+}
+
+func (s *FSSuite) TestAddDirectory_HardLink(c *C) {
+	dir := makeDirFixture()
+	os.Link(filepath.Join(dir, "bar"), filepath.Join(dir, "baz/link"))
+
+	n, err := AddDirectory(s.a, dir, "/", true)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 4)
+
+	bar, _ := s.a.Stat("/bar")
+	link, _ := s.a.Stat("/baz/link")
+	c.Assert(SameFile(bar, link), Equals, true)
+	c.Assert(link.Sys().(Inode).Links, Equals, uint32(2))
+}
+
+func (s *FSSuite) TestAddTarContent_HardLink(c *C) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	w.WriteHeader(&tar.Header{Name: "foo", Mode: 0644, Size: 3, Typeflag: tar.TypeReg})
+	w.Write([]byte("foo"))
+	w.WriteHeader(&tar.Header{Name: "bar", Linkname: "foo", Typeflag: tar.TypeLink})
+	w.Close()
+
+	n, err := AddTarContent(s.a, buf, "/")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	foo, _ := s.a.Stat("/foo")
+	bar, _ := s.a.Stat("/bar")
+	c.Assert(SameFile(foo, bar), Equals, true)
+}
+
+func (s *FSSuite) TestAddFile_Xattr(c *C) {
+	src, err := ioutil.TempFile("/tmp/", "xattr_raa")
+	c.Assert(err, IsNil)
+	src.Close()
+
+	if err := syscall.Setxattr(src.Name(), "user.foo", []byte("bar"), 0); err != nil {
+		c.Skip("extended attributes not supported")
+	}
+
+	_, err = AddFile(s.a, src.Name(), "/foo")
+	c.Assert(err, IsNil)
+
+	value, err := s.a.Getxattr("/foo", "user.foo")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "bar")
+}
+
+func (s *FSSuite) TestAddTarContent_Xattr(c *C) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	w.WriteHeader(&tar.Header{
+		Name: "foo", Mode: 0644, Typeflag: tar.TypeReg, Format: tar.FormatPAX,
+		PAXRecords: map[string]string{"SCHILY.xattr.user.foo": "bar"},
+	})
+	w.WriteHeader(&tar.Header{
+		Name: "qux/", Mode: 0755, Typeflag: tar.TypeDir, Format: tar.FormatPAX,
+		PAXRecords: map[string]string{"SCHILY.xattr.security.capability": "baz"},
+	})
+	w.Close()
+
+	_, err := AddTarContent(s.a, buf, "/")
+	c.Assert(err, IsNil)
+
+	value, err := s.a.Getxattr("/foo", "user.foo")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "bar")
+
+	value, err = s.a.Getxattr("/qux", "security.capability")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "baz")
+}
+
+func (s *FSSuite) TestAddTarContent_Symlink(c *C) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	w.WriteHeader(&tar.Header{Name: "lib.so.1", Mode: 0644, Size: 3, Typeflag: tar.TypeReg})
+	w.Write([]byte("foo"))
+	w.WriteHeader(&tar.Header{Name: "lib.so", Linkname: "lib.so.1", Uid: 42, Typeflag: tar.TypeSymlink})
+	w.Close()
+
+	n, err := AddTarContent(s.a, buf, "/lib")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	fi, err := s.a.Lstat("/lib/lib.so")
+	c.Assert(err, IsNil)
+	c.Assert(fi.Sys().(Inode).UserId, Equals, uint64(42))
+
+	f, err := s.a.Open("/lib/lib.so")
+	c.Assert(err, IsNil)
+	c.Assert(f.String(), Equals, "foo")
+}
+
+func (s *FSSuite) TestAddTarContent_SymlinkOverDir(c *C) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	w.WriteHeader(&tar.Header{Name: "a/x", Mode: 0644, Size: 3, Typeflag: tar.TypeReg})
+	w.Write([]byte("foo"))
+	w.WriteHeader(&tar.Header{Name: "a", Linkname: "../../escape", Typeflag: tar.TypeSymlink})
+	w.Close()
+
+	_, err := AddTarContent(s.a, buf, "/")
+	c.Assert(os.IsExist(err), Equals, true)
+
+	fi, err := s.a.Lstat("/a")
+	c.Assert(err, IsNil)
+	c.Assert(fi.IsDir(), Equals, true)
+}
+
+func (s *FSSuite) TestAddTarContent_FileUnderFile(c *C) {
+	buf := bytes.NewBuffer(nil)
+	w := tar.NewWriter(buf)
+	w.WriteHeader(&tar.Header{Name: "a", Mode: 0644, Size: 3, Typeflag: tar.TypeReg})
+	w.Write([]byte("foo"))
+	w.WriteHeader(&tar.Header{Name: "a/b", Mode: 0644, Size: 3, Typeflag: tar.TypeReg})
+	w.Write([]byte("bar"))
+	w.Close()
+
+	_, err := AddTarContent(s.a, buf, "/")
+	c.Assert(err.(*os.PathError).Err, Equals, NotDirectoryErr)
+
+	f, _ := s.a.Open("/a")
+	c.Assert(f.String(), Equals, "foo")
+}
+
+func umask() os.FileMode {
+	m := syscall.Umask(0)
+	syscall.Umask(m)
+
+	return os.FileMode(m)
 }
 
 func makeDirFixture() string {
@@ -75,6 +261,10 @@ func makeDirFixture() string {
 
 	makeFileFixture(filepath.Join(dir, "baz/baz"), "baz")
 
+	if err := os.Mkdir(filepath.Join(dir, "empty"), 0700); err != nil {
+		panic(err)
+	}
+
 	return dir
 }
 
@@ -104,6 +294,14 @@ func (s *FSSuite) TestAddTarContent(c *C) {
 	}
 
 	AssertVolumeAgainstTar(c, v, fixtureSmallTar, 61)
+
+	fi, err := v.Stat("/package/rpm")
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode(), Equals, os.ModeDir|0755)
+
+	fi, err = v.Stat("/Makefile")
+	c.Assert(err, IsNil)
+	c.Assert(fi.ModTime().Unix(), Equals, int64(1428601174))
 }
 
 func AssertVolumeAgainstTar(c *C, a *Archive, tar string, files int) {
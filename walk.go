@@ -0,0 +1,263 @@
+package raa
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mcuadros/bolt"
+)
+
+// SkipDir is used as a return value from WalkFuncs to indicate that the
+// directory named in the call is to be skipped. It is the same value as
+// filepath.SkipDir.
+var SkipDir = filepath.SkipDir
+
+// WalkFunc is the type of the function called for each file or directory
+// visited by Walk, see filepath.WalkFunc.
+type WalkFunc func(path string, info os.FileInfo, err error) error
+
+// WalkDirFunc is the type of the function called for each file or directory
+// visited by WalkDir, see fs.WalkDirFunc.
+type WalkDirFunc func(path string, d os.DirEntry, err error) error
+
+// Walk walks the file tree rooted at root, calling fn for each file or
+// directory in the tree, including root. The inodes are read in the same read
+// transaction that lists the names, so fn gets the FileInfo without any
+// further lookup. Symbolic links are not followed.
+//
+// The files are walked in the order of his full path, unlike filepath.Walk
+// "/foo.txt" is visited before "/foo/bar". The directories without entry are
+// visited with the FileInfo of implicitDirInode. fn should not modify the
+// archive.
+func (a *Archive) Walk(root string, fn WalkFunc) error {
+	return a.walk(root, func(path string, info *FileInfo, err error) error {
+		if info == nil {
+			return fn(path, nil, err)
+		}
+
+		return fn(path, info, err)
+	})
+}
+
+// WalkDir is like Walk but calling fn with an os.DirEntry.
+func (a *Archive) WalkDir(root string, fn WalkDirFunc) error {
+	return a.walk(root, func(path string, info *FileInfo, err error) error {
+		if info == nil {
+			return fn(path, nil, err)
+		}
+
+		return fn(path, &dirEntry{info}, err)
+	})
+}
+
+func (a *Archive) walk(root string, fn func(string, *FileInfo, error) error) error {
+	name, err := a.resolve(root, false)
+	if err != nil {
+		return ignoreSkipDir(fn(root, nil, &os.PathError{"walk", root, err}))
+	}
+
+	return a.view(func(tx *bolt.Tx) error {
+		info, err := walkInfo(tx, name)
+		if err != nil {
+			return ignoreSkipDir(fn(name, nil, &os.PathError{"walk", name, err}))
+		}
+
+		if err := fn(name, info, nil); err != nil || !info.IsDir() {
+			return ignoreSkipDir(err)
+		}
+
+		b := tx.Bucket(rootBucket)
+		if b == nil {
+			return nil
+		}
+
+		return ignoreSkipDir(walkKeys(tx, b, name, fn))
+	})
+}
+
+// walkKeys calls fn for every name under the directory root, seeking the
+// cursor to the prefix of root and past the skipped directories
+func walkKeys(tx *bolt.Tx, b *bolt.Bucket, root string, fn func(string, *FileInfo, error) error) error {
+	prefix := []byte(dirPrefix(root))
+
+	// implicit holds the directories without entry already visited, his
+	// descendants are contiguous so it works as a stack
+	var implicit []string
+
+	// skipped holds the directories skipped whose descendants are not yet
+	// reached, names as "/foo.txt" sort between "/foo" and "/foo/"
+	var skipped []string
+
+	c := b.Cursor()
+	k, v := c.Seek(prefix)
+	for k != nil && bytes.HasPrefix(k, prefix) {
+		name := string(k)
+		if dir := nextSkipped(&skipped, name); dir != "" {
+			// the byte following the separator, seeks past every descendant
+			k, v = c.Seek([]byte(dir + "0"))
+			continue
+		}
+
+		for len(implicit) > 0 && !strings.HasPrefix(name, implicit[len(implicit)-1]+"/") {
+			implicit = implicit[:len(implicit)-1]
+		}
+
+		skip, err := walkImplicitDirs(b, root, name, &implicit, fn)
+		if err != nil {
+			return err
+		}
+
+		if skip == "" {
+			info := &FileInfo{name: name}
+			err = readInodeValue(tx, v, &info.inode)
+			if err != nil {
+				err = fn(name, nil, &os.PathError{"walk", name, err})
+			} else {
+				err = fn(name, info, nil)
+			}
+
+			switch {
+			case err == SkipDir && info.IsDir():
+				skipped = append(skipped, name)
+			case err == SkipDir:
+				skip = filepath.Dir(name)
+			case err != nil:
+				return err
+			}
+		}
+
+		if skip == "" {
+			k, v = c.Next()
+			continue
+		}
+
+		if skip == root {
+			return nil
+		}
+
+		// the byte following the separator, seeks past every descendant
+		k, v = c.Seek([]byte(skip + "0"))
+	}
+
+	return nil
+}
+
+// nextSkipped returns the skipped directory containing name, if any, the
+// directories left behind by name are removed from skipped
+func nextSkipped(skipped *[]string, name string) string {
+	var dir string
+	left := (*skipped)[:0]
+	for _, d := range *skipped {
+		switch {
+		case strings.HasPrefix(name, d+"/"):
+			dir = d
+		case name < d+"/":
+			left = append(left, d)
+		}
+	}
+
+	*skipped = left
+	return dir
+}
+
+// walkImplicitDirs visits the ancestors of name without entry not visited yet,
+// returns the directory to skip if fn returned SkipDir
+func walkImplicitDirs(b *bolt.Bucket, root, name string, implicit *[]string, fn func(string, *FileInfo, error) error) (string, error) {
+	start := len(dirPrefix(root))
+	if len(*implicit) > 0 {
+		start = len((*implicit)[len(*implicit)-1]) + 1
+	}
+
+	for i := strings.Index(name[start:], "/"); i != -1; i = strings.Index(name[start:], "/") {
+		dir := name[:start+i]
+		start += i + 1
+
+		if b.Get([]byte(dir)) != nil {
+			continue
+		}
+
+		err := fn(dir, &FileInfo{name: dir, inode: implicitDirInode}, nil)
+		if err == SkipDir {
+			return dir, nil
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		*implicit = append(*implicit, dir)
+	}
+
+	return "", nil
+}
+
+// walkInfo returns the FileInfo of the named file, the directories without
+// entry get an implicit FileInfo
+func walkInfo(tx *bolt.Tx, name string) (*FileInfo, error) {
+	info := &FileInfo{name: name, inode: implicitDirInode}
+	if name == "/" {
+		return info, nil
+	}
+
+	b := tx.Bucket(rootBucket)
+	if b == nil {
+		return nil, notFoundError
+	}
+
+	if v := b.Get([]byte(name)); v != nil {
+		return info, readInodeValue(tx, v, &info.inode)
+	}
+
+	if !hasChildrenKeys(b, name) {
+		return nil, notFoundError
+	}
+
+	return info, nil
+}
+
+// readInodeValue reads the inode with the given id
+func readInodeValue(tx *bolt.Tx, id []byte, i *Inode) error {
+	file := getInodeBucket(tx, id)
+	if file == nil {
+		return notFoundError
+	}
+
+	inode, err := getInode(file)
+	if err != nil {
+		return err
+	}
+
+	*i = *inode
+	return nil
+}
+
+func ignoreSkipDir(err error) error {
+	if err == SkipDir {
+		return nil
+	}
+
+	return err
+}
+
+// dirEntry is the os.DirEntry of a FileInfo
+type dirEntry struct {
+	info *FileInfo
+}
+
+func (d *dirEntry) Name() string {
+	return d.info.Name()
+}
+
+func (d *dirEntry) IsDir() bool {
+	return d.info.IsDir()
+}
+
+func (d *dirEntry) Type() os.FileMode {
+	return d.info.Mode().Type()
+}
+
+func (d *dirEntry) Info() (os.FileInfo, error) {
+	return d.info, nil
+}
@@ -0,0 +1,107 @@
+package raa
+
+import (
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *FSSuite) TestArchive_Walk(c *C) {
+	c.Assert(s.a.MkdirAll("/foo/bar", 0755), IsNil)
+	for _, name := range []string{"/foo/bar/qux", "/foo.txt", "/foo/baz", "/qux/implicit/foo"} {
+		f, _ := s.a.Create(name)
+		f.WriteString(name)
+		f.Close()
+	}
+
+	c.Assert(s.a.Symlink("/foo", "/link"), IsNil)
+
+	var names []string
+	sizes := make(map[string]int64, 0)
+	err := s.a.Walk("/", func(path string, info os.FileInfo, err error) error {
+		c.Assert(err, IsNil)
+		names = append(names, path)
+		sizes[path] = info.Size()
+		return nil
+	})
+
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{
+		"/", "/foo", "/foo.txt", "/foo/bar", "/foo/bar/qux", "/foo/baz",
+		"/link", "/qux", "/qux/implicit", "/qux/implicit/foo",
+	})
+
+	c.Assert(sizes["/foo/bar/qux"], Equals, int64(12))
+	c.Assert(sizes["/link"], Equals, int64(4))
+}
+
+func (s *FSSuite) TestArchive_WalkSkipDir(c *C) {
+	c.Assert(s.a.MkdirAll("/foo/bar", 0755), IsNil)
+	c.Assert(s.a.Mkdir("/foo/bar-x", 0755), IsNil)
+	for _, name := range []string{
+		"/foo/bar/qux", "/foo/bar-x/qux", "/foo/bar.txt", "/foo/baz",
+		"/foo/qux", "/foo/zzz/foo", "/zzz",
+	} {
+		f, _ := s.a.Create(name)
+		f.Close()
+	}
+
+	var names []string
+	err := s.a.Walk("foo", func(path string, info os.FileInfo, err error) error {
+		names = append(names, path)
+		switch path {
+		case "/foo/bar", "/foo/bar-x", "/foo/zzz":
+			return SkipDir
+		case "/foo/qux":
+			return SkipDir
+		}
+
+		return nil
+	})
+
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{
+		"/foo", "/foo/bar", "/foo/bar-x", "/foo/bar.txt", "/foo/baz", "/foo/qux",
+	})
+
+	names = nil
+	err = s.a.Walk("/foo/baz", func(path string, info os.FileInfo, err error) error {
+		names = append(names, path)
+		return nil
+	})
+
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"/foo/baz"})
+}
+
+func (s *FSSuite) TestArchive_WalkNotExist(c *C) {
+	err := s.a.Walk("/foo", func(path string, info os.FileInfo, err error) error {
+		c.Assert(info, IsNil)
+		return err
+	})
+
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *FSSuite) TestArchive_WalkDir(c *C) {
+	c.Assert(s.a.Mkdir("/foo", 0755), IsNil)
+	f, _ := s.a.Create("/foo/bar")
+	f.WriteString("bar")
+	f.Close()
+
+	var names []string
+	err := s.a.WalkDir("/foo", func(path string, d os.DirEntry, err error) error {
+		c.Assert(err, IsNil)
+		names = append(names, d.Name())
+
+		info, _ := d.Info()
+		if !d.IsDir() {
+			c.Assert(info.Size(), Equals, int64(3))
+		}
+
+		return nil
+	})
+
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"foo", "bar"})
+}
@@ -0,0 +1,214 @@
+package raa
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/mcuadros/bolt"
+)
+
+var (
+	NoXattrErr      = errors.New("no such attribute")
+	InvalidXattrErr = errors.New("invalid attribute name")
+)
+
+// Getxattr returns the value of the extended attribute of the named file.
+// If there is an error, it will be of type *PathError.
+func (a *Archive) Getxattr(name, attr string) ([]byte, error) {
+	f, err := a.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	return f.Getxattr(attr)
+}
+
+// Setxattr sets the value of the extended attribute of the named file.
+// If there is an error, it will be of type *PathError.
+func (a *Archive) Setxattr(name, attr string, value []byte) error {
+	f, err := a.Open(name)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Setxattr(attr, value); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Listxattr returns the sorted names of the extended attributes of the named
+// file.
+// If there is an error, it will be of type *PathError.
+func (a *Archive) Listxattr(name string) ([]string, error) {
+	f, err := a.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	return f.Listxattr()
+}
+
+// Removexattr removes the extended attribute of the named file.
+// If there is an error, it will be of type *PathError.
+func (a *Archive) Removexattr(name, attr string) error {
+	f, err := a.Open(name)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Removexattr(attr); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// readXattrs returns the extended attributes of the given inode
+func (a *Archive) readXattrs(inode uint64) (map[string][]byte, error) {
+	r := make(map[string][]byte, 0)
+	if inode == 0 {
+		return r, nil
+	}
+
+	err := a.view(func(tx *bolt.Tx) error {
+		file := getInodeBucket(tx, inodeKey(inode))
+		if file == nil {
+			return nil
+		}
+
+		xattrs := file.Bucket(xattrsBucket)
+		if xattrs == nil {
+			return nil
+		}
+
+		return xattrs.ForEach(func(k, v []byte) error {
+			r[string(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+
+	return r, err
+}
+
+// writeXattrs stores the extended attributes changed at the file, the nil
+// values are deleted
+func writeXattrs(file *bolt.Bucket, xattrs map[string][]byte) error {
+	if len(xattrs) == 0 {
+		return nil
+	}
+
+	b, err := file.CreateBucketIfNotExists(xattrsBucket)
+	if err != nil {
+		return err
+	}
+
+	for attr, value := range xattrs {
+		key := []byte(attr)
+		if value == nil {
+			err = b.Delete(key)
+		} else {
+			err = b.Put(key, value)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Getxattr returns the value of the extended attribute.
+func (f *File) Getxattr(attr string) ([]byte, error) {
+	xattrs, err := f.getXattrs()
+	if err != nil {
+		return nil, &os.PathError{"getxattr", f.name, err}
+	}
+
+	value, ok := xattrs[attr]
+	if !ok {
+		return nil, &os.PathError{"getxattr", f.name, NoXattrErr}
+	}
+
+	return value, nil
+}
+
+// Setxattr sets the value of the extended attribute, the attribute is stored
+// when the file is synced.
+func (f *File) Setxattr(attr string, value []byte) error {
+	if attr == "" {
+		return &os.PathError{"setxattr", f.name, InvalidXattrErr}
+	}
+
+	if value == nil {
+		value = []byte{}
+	}
+
+	f.xattrs[attr] = append([]byte(nil), value...)
+	f.inode.ChangedAt = time.Now()
+	f.isDirty = true
+
+	return nil
+}
+
+// Listxattr returns the sorted names of the extended attributes.
+func (f *File) Listxattr() ([]string, error) {
+	xattrs, err := f.getXattrs()
+	if err != nil {
+		return nil, &os.PathError{"listxattr", f.name, err}
+	}
+
+	names := make([]string, 0, len(xattrs))
+	for attr := range xattrs {
+		names = append(names, attr)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Removexattr removes the extended attribute, the attribute is deleted when
+// the file is synced.
+func (f *File) Removexattr(attr string) error {
+	xattrs, err := f.getXattrs()
+	if err != nil {
+		return &os.PathError{"removexattr", f.name, err}
+	}
+
+	if _, ok := xattrs[attr]; !ok {
+		return &os.PathError{"removexattr", f.name, NoXattrErr}
+	}
+
+	f.xattrs[attr] = nil
+	f.inode.ChangedAt = time.Now()
+	f.isDirty = true
+
+	return nil
+}
+
+// getXattrs returns the stored extended attributes with the pending changes
+func (f *File) getXattrs() (map[string][]byte, error) {
+	xattrs, err := f.a.readXattrs(f.inode.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	for attr, value := range f.xattrs {
+		if value == nil {
+			delete(xattrs, attr)
+			continue
+		}
+
+		xattrs[attr] = value
+	}
+
+	return xattrs, nil
+}
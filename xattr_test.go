@@ -0,0 +1,72 @@
+package raa
+
+import (
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *FSSuite) TestArchive_Xattr(c *C) {
+	f, _ := s.a.Create("/foo")
+	f.WriteString("foo")
+	f.Close()
+
+	c.Assert(s.a.Setxattr("/foo", "user.foo", []byte("bar")), IsNil)
+	c.Assert(s.a.Setxattr("/foo", "security.capability", []byte{1, 2}), IsNil)
+
+	value, err := s.a.Getxattr("/foo", "user.foo")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "bar")
+
+	names, err := s.a.Listxattr("/foo")
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"security.capability", "user.foo"})
+
+	c.Assert(s.a.Removexattr("/foo", "user.foo"), IsNil)
+
+	_, err = s.a.Getxattr("/foo", "user.foo")
+	c.Assert(err.(*os.PathError).Err, Equals, NoXattrErr)
+
+	err = s.a.Removexattr("/foo", "user.foo")
+	c.Assert(err.(*os.PathError).Err, Equals, NoXattrErr)
+
+	f, _ = s.a.Open("/foo")
+	c.Assert(f.String(), Equals, "foo")
+}
+
+func (s *FSSuite) TestFile_Xattr(c *C) {
+	f, _ := s.a.Create("/foo")
+	c.Assert(f.Setxattr("user.foo", []byte("foo")), IsNil)
+	c.Assert(f.Setxattr("", nil), FitsTypeOf, &os.PathError{})
+
+	value, err := f.Getxattr("user.foo")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "foo")
+	f.Close()
+
+	s.a.Link("/foo", "/bar")
+
+	f, _ = s.a.Open("/bar")
+	value, err = f.Getxattr("user.foo")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "foo")
+
+	f.Removexattr("user.foo")
+	names, err := f.Listxattr()
+	c.Assert(err, IsNil)
+	c.Assert(names, HasLen, 0)
+	f.Close()
+
+	names, _ = s.a.Listxattr("/foo")
+	c.Assert(names, HasLen, 0)
+}
+
+func (s *FSSuite) TestArchive_RemoveWithXattr(c *C) {
+	f, _ := s.a.Create("/foo")
+	f.WriteString("foo")
+	f.Setxattr("user.foo", []byte("foo"))
+	f.Close()
+
+	c.Assert(s.a.Remove("/foo"), IsNil)
+	c.Assert(countBlocks(s.a), Equals, 0)
+}